@@ -1,8 +1,18 @@
 package ded
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -42,6 +52,27 @@ type Expirer interface {
 	IsExpired(Timed) bool
 }
 
+/*
+Optional extension of `Expirer` for expirers that depend on the current time.
+Allows the caller to inject "now" instead of reading the real clock, which
+makes expiration deterministic, for example in tests. Implemented by
+`Duration`, `NowExpirer` and `Inst`, whose `.IsExpired` delegates to
+`.IsExpiredAt(val, time.Now())`. See `IsExpiredAt` and `Mem.DedupAt`.
+*/
+type ExpirerAt interface {
+	IsExpiredAt(Timed, time.Time) bool
+}
+
+/*
+Getter that also determines when its value expires, for upstreams that report
+expiration together with the data, such as JWT "exp" claims or HTTP cache
+headers. Used by `Mem.DedupExpiring`. The returned time is an absolute
+deadline. Follows the same rules as `Getter` for errors.
+*/
+type ExpiringGetter interface {
+	GetExpiring() (interface{}, time.Time)
+}
+
 // Implemented by `*Mem`. Part of the `Omni` interface.
 type Deduper interface {
 	Dedup(Getter, Timer, Expirer) Timed
@@ -62,104 +93,1307 @@ type Omni interface {
 }
 
 /*
-Creates an instance of `Mem` with the given value and time. Defined mostly for
-tests. User code shouldn't have to instantiate `Mem` manually, because the zero
-value is ready to use.
+Creates an instance of `Mem` with the given value and time. Defined mostly for
+tests. User code shouldn't have to instantiate `Mem` manually, because the zero
+value is ready to use.
+*/
+func NewMem(val Timed) *Mem {
+	var out Mem
+	out.ptr.Store(&val)
+	return &out
+}
+
+/*
+Tool for deduplicating data-fetching operations. The zero value is ready to use,
+but must not be copied (use it by pointer). Conceptually, this is something
+like `atomic.Value<Timed>`, with the added ability to synchronize writers, and
+to avoid generating new states when the value is not expired.
+
+Reads are lock-free: the current state is published via an atomic pointer, and
+readers never wait for each other or for an active writer, observing the last
+stored state. Writes are serialized by a mutex.
+
+Intended for simultaneous use by many concurrent readers. As such, all methods
+of `*Mem` are concurrency-safe.
+
+Because `Mem` contains a mutex, the "copylocks" check of `go vet` reports
+accidental copies. To duplicate a `Mem`, use `.Clone`.
+
+A getter or timer must not call back into the same `Mem` to write to it, for
+example via `.Dedup` with an expired value: the write lock is not reentrant,
+and such calls deadlock. See `.SetDetectReentrancy` for an optional safety
+net.
+Reads are ok, and observe the previous state.
+*/
+type Mem struct {
+	writer   atomic.Uint64
+	gen      atomic.Uint64
+	lock     sync.Mutex
+	ptr      atomic.Pointer[Timed]
+	stale    uint32
+	once     uint32
+	detect   bool
+	listener func(prev, next Timed)
+	pend     *memTransition
+	subs     map[*memSub]struct{}
+}
+
+/*
+Shorthand for `.GetTimed().Get()`. Returns the currently-cached inner value,
+which is initially nil. If an error is currently cached, panics with that
+error. Never blocks: if a writer is currently generating a new value, this
+returns the previous value.
+*/
+func (self *Mem) Get() interface{} { return self.GetTimed().Get() }
+
+/*
+Shorthand for `.GetTimed().Unwrap()`. Non-panicking variant of `.Get`: if an
+error is currently cached, returns `(nil, err)`. Initially returns `(nil, nil)`.
+Never blocks, just like `.GetTimed`.
+*/
+func (self *Mem) GetErr() (interface{}, error) { return self.GetTimed().Unwrap() }
+
+/*
+Shorthand for `.GetTimed().Copy().Get()`. Same as `.Get`, but returns a deep
+copy of the cached slice or map, which the caller may mutate without affecting
+the cache. See `Timed.Copy` for the cost and limitations.
+*/
+func (self *Mem) GetCopy() interface{} { return self.GetTimed().Copy().Get() }
+
+/*
+Returns the currently-cached state. Initially this returns the zero value
+`Timed{}`. Lock-free and never blocks: if a writer is currently generating a
+new value, this returns the last stored state.
+*/
+func (self *Mem) GetTimed() Timed { return derefTimed(self.ptr.Load()) }
+
+/*
+Same as `.GetTimed`, but if the current state is empty, returns the provided
+fallback instead. "Empty" means exactly `Timed{}`: nil inner value and zero
+timestamp. A cached error or a cached nil with a non-zero timestamp is not
+empty.
+*/
+func (self *Mem) GetTimedOr(fallback Timed) Timed {
+	val := self.GetTimed()
+	if val.IsZero() {
+		return fallback
+	}
+	return val
+}
+
+/*
+Returns the current state and true. Formerly a non-blocking variant of
+`.GetTimed`, which returned false when a writer held the lock. Since reads no
+longer wait for writers, this always succeeds; prefer `.GetTimed`.
+*/
+func (self *Mem) TryGetTimed() (Timed, bool) { return self.GetTimed(), true }
+
+/*
+Returns the current state, and whether it's expired according to the provided
+expirer. Never calls a getter. Useful for inspecting the cache, for example in
+health or debug endpoints. The expirer is invoked on a snapshot of the state,
+without holding any lock.
+*/
+func (self *Mem) Peek(exp Expirer) (Timed, bool) {
+	val := self.GetTimed()
+	return val, IsExpired(exp, val)
+}
+
+/*
+Shorthand for `.GetTimed().Age(time.Now())`. Returns the age of the currently
+cached state. See `Timed.Age` for the treatment of zero timestamps.
+*/
+func (self *Mem) Age() time.Duration { return self.GetTimed().Age(time.Now()) }
+
+/*
+True if the current state is expired according to the provided expirer. Same
+as the second result of `.Peek`. Never calls a getter. Nil expirer is always
+expired.
+*/
+func (self *Mem) Expired(exp Expirer) bool {
+	_, expired := self.Peek(exp)
+	return expired
+}
+
+/*
+Canonical "no-fetch" variant of `.Dedup`. Returns the current state, and
+whether it's fresh according to the provided expirer. Never calls a getter,
+never takes the write lock, and never modifies the state, even when the value
+is expired. Useful when regenerating is undesirable, for example while
+draining during shutdown. Same as `.Peek`, but reports freshness rather than
+expiration.
+*/
+func (self *Mem) DedupReadOnly(exp Expirer) (_ Timed, fresh bool) {
+	val, expired := self.Peek(exp)
+	return val, !expired
+}
+
+// Replaces the cached state with the provided state.
+func (self *Mem) SetTimed(val Timed) {
+	self.wlock()
+	defer self.unlock()
+	self.store(val)
+}
+
+// Same as `.GetTimed`. Matches the naming of `atomic.Value`.
+func (self *Mem) Load() Timed { return self.GetTimed() }
+
+// Same as `.SetTimed`. Matches the naming of `atomic.Value`.
+func (self *Mem) Store(val Timed) { self.SetTimed(val) }
+
+/*
+Replaces the cached state with the provided state, and returns the previous
+state. Both happen atomically under the write lock, so no other write can
+happen in between. Matches the naming of `atomic.Value`.
+*/
+func (self *Mem) Swap(val Timed) Timed {
+	self.wlock()
+	defer self.unlock()
+	prev := self.GetTimed()
+	self.store(val)
+	return prev
+}
+
+/*
+Replaces the cached state with `next` only if the current state equals `prev`,
+and returns true on success. The comparison and the write happen atomically
+under the write lock, which allows optimistic update loops: read the state,
+compute the next state, then retry if another writer got in between.
+
+Equality is determined via `reflect.DeepEqual`, which compares both the
+timestamp and the inner value. Because the inner value is `interface{}`, it
+must have the same dynamic type; values of different types are never equal,
+even when they look identical, such as `int(10)` and `int64(10)`. Pointers,
+slices and maps are compared deeply, by their contents. Timestamps are compared
+field by field, including the location and the monotonic clock reading, so
+times that represent the same instant via different locations are not equal.
+*/
+func (self *Mem) CompareAndSwapTimed(prev, next Timed) bool {
+	self.wlock()
+	defer self.unlock()
+
+	if !reflect.DeepEqual(self.GetTimed(), prev) {
+		return false
+	}
+	self.store(next)
+	return true
+}
+
+/*
+Conditional variant of `.SetTimed`. Uses the same double-checked expiration
+logic as `.Dedup`, but instead of calling a getter, stores the provided state.
+If the current state is expired, replaces it and returns `(val, true)`.
+Otherwise returns the current state and false.
+*/
+func (self *Mem) SetIfExpired(val Timed, exp Expirer) (Timed, bool) {
+	prev := self.GetTimed()
+	if !IsExpired(exp, prev) {
+		return prev, false
+	}
+
+	self.wlock()
+	defer self.unlock()
+
+	prev = self.GetTimed()
+	if !IsExpired(exp, prev) {
+		return prev, false
+	}
+
+	self.store(val)
+	return val, true
+}
+
+/*
+Conditional variant of `.Zero`. If the current state is expired according to
+the provided expirer, zeroes it and returns true. Otherwise returns false. Uses
+the same double-checked expiration logic as `.Dedup`. A nil expirer, which
+always expires, clears unconditionally.
+*/
+func (self *Mem) Invalidate(exp Expirer) bool {
+	if !IsExpired(exp, self.GetTimed()) {
+		return false
+	}
+
+	self.wlock()
+	defer self.unlock()
+
+	if !IsExpired(exp, self.GetTimed()) {
+		return false
+	}
+
+	self.store(Timed{})
+	return true
+}
+
+/*
+Returns a new independent `*Mem` holding a copy of the current state. The
+clone doesn't share the lock or any other state with the original. The inner
+value itself is copied shallowly.
+*/
+func (self *Mem) Clone() *Mem { return NewMem(self.GetTimed()) }
+
+// Zeroes the state, resetting it to `Timed{}`.
+func (self *Mem) Zero() { self.SetTimed(Timed{}) }
+
+/*
+Sets a callback invoked after every write, with the previous and the new
+state. Intended for auditing and debugging cache behavior. Writes include
+`.SetTimed`, `.Zero`, and each regeneration in `.Dedup` and its variants, even
+when the new state is identical to the previous one. Calls that find a fresh
+value don't write, and don't invoke the callback. Nil removes the listener.
+
+The callback is invoked outside the lock, to avoid deadlocks, on the goroutine
+that performed the write. It receives snapshots, and may be invoked
+concurrently, in a different order than the writes happened. It should not call
+back into the same `Mem` synchronously: reads may observe later states, and
+writes would trigger the callback recursively.
+*/
+func (self *Mem) SetListener(fun func(prev, next Timed)) {
+	self.wlock()
+	defer self.lock.Unlock()
+	self.listener = fun
+}
+
+/*
+Enables or disables reentrancy detection. When enabled, while a getter or timer
+runs under the write lock, the `Mem` records the id of the current goroutine,
+and methods that would have to wait for the lock check it, panicking with
+`ErrReentrant` instead of deadlocking. Disabled by default, because getting
+the goroutine id is relatively slow (a few microseconds), and adds this cost
+to every regeneration. Meant for tests and debugging.
+
+The check is a heuristic: it only covers getters and timers called under the
+lock, and doesn't detect reentrancy from other goroutines spawned by the
+getter, which still deadlocks if the getter waits for them.
+*/
+func (self *Mem) SetDetectReentrancy(val bool) {
+	self.wlock()
+	defer self.lock.Unlock()
+	self.detect = val
+}
+
+/*
+Returns a channel that receives the new state after every write, and a function
+that unsubscribes. Writes are the same as for `.SetListener`: they include
+`.SetTimed`, `.Zero`, and each regeneration in `.Dedup` and its variants.
+Multiple subscribers each get their own channel.
+
+Delivery never blocks writers. The channel has a buffer of 1, and slow
+subscribers get coalesced updates: if the previous state hasn't been received
+yet when the next write happens, it's replaced, so a subscriber always
+eventually receives the latest state, but may miss intermediate ones. The
+current state is not sent on subscription; use `.GetTimed` for that.
+
+The unsubscribe function stops delivery and closes the channel, after which
+receiving yields at most one pending state, then the zero `Timed` with `ok ==
+false`. Calling it more than once is ok. Subscribers must unsubscribe to allow
+the channel to be garbage-collected while the `Mem` is in use.
+*/
+func (self *Mem) Subscribe() (<-chan Timed, func()) {
+	sub := &memSub{out: make(chan Timed, 1)}
+
+	self.wlock()
+	defer self.lock.Unlock()
+
+	if self.subs == nil {
+		self.subs = map[*memSub]struct{}{}
+	}
+	self.subs[sub] = struct{}{}
+	return sub.out, func() { self.unsubscribe(sub) }
+}
+
+func (self *Mem) unsubscribe(sub *memSub) {
+	self.wlock()
+	defer self.lock.Unlock()
+
+	_, ok := self.subs[sub]
+	if ok {
+		delete(self.subs, sub)
+		close(sub.out)
+	}
+}
+
+/*
+Returns the number of writes performed on this `Mem`, starting at 0. Every
+write increments it by one, including `.SetTimed`, `.Zero`, and each
+regeneration in `.Dedup` and its variants. Calls that find a fresh value don't
+write, and don't increment the generation. Comparing generations from two
+points in time tells whether the state was rewritten in between, without
+comparing the values. Doesn't wait for an active writer.
+*/
+func (self *Mem) Generation() uint64 { return self.gen.Load() }
+
+/*
+Main API of this package. Uses the provided expirer to determine the freshness
+of the currently-stored value. If fresh enough, returns the value as-is.
+Otherwise, uses the provided getter and timer to generate a new value with its
+timestamp, and returns the new result.
+
+The fast path is lock-free: callers that consider the current value fresh
+return it without touching the write lock, even while another writer is
+regenerating the value. The provided getter is assumed to be slow and
+expensive. Callers that consider the value expired take the write lock, and
+only the writer holding it is allowed to regenerate the value by calling the
+getter. Others wait for the lock, then re-check expiration, usually reusing the
+value produced by the first writer.
+
+Reading doesn't allocate. Each regeneration allocates one `Timed`, which is
+published to readers via an atomic pointer. Other allocations come from the
+getter's result, for example from converting a non-pointer value to
+`interface{}`, which can't be avoided by reusing `Timed`.
+*/
+func (self *Mem) Dedup(get Getter, time Timer, exp Expirer) Timed {
+	val, _ := self.dedup(get, time, exp)
+	return val
+}
+
+/*
+Variant of `.Dedup` that also reports whether this call regenerated the value.
+The boolean is true only when this goroutine called the getter and stored the
+new value. Readers that waited behind another writer and received its new value
+get false, because they didn't produce it. Among concurrent callers that all
+observe the same expired value, at most one gets true.
+*/
+func (self *Mem) DedupReport(get Getter, time Timer, exp Expirer) (Timed, bool) {
+	return self.dedup(get, time, exp)
+}
+
+/*
+Variant of `.Dedup` that also reports the wall-clock time spent in the getter,
+for profiling expensive fetches without wrapping every getter. The duration is
+non-zero only when this call regenerated the value, like the boolean of
+`.DedupReport`. It's zero on a cache hit, including for readers that waited
+behind another writer and reused its value. Includes getters that panic, and
+excludes the timer and the time spent waiting for the lock.
+*/
+func (self *Mem) DedupElapsed(get Getter, time Timer, exp Expirer) (_ Timed, elapsed time.Duration) {
+	val, _ := self.dedup(elapsedGetter{get, &elapsed}, time, exp)
+	return val, elapsed
+}
+
+/*
+Populates the cache by calling the getter and the timer, but only if the current
+state is empty, meaning exactly `Timed{}`. Does nothing if already populated,
+regardless of expiration. Intended for pre-warming caches synchronously at
+startup, so that the first real request is fast. Uses the same double-checked
+locking as `.Dedup` with `ExpireNever`: the getter is called under the write
+lock, and concurrent calls to `.Warm` call it only once.
+*/
+func (self *Mem) Warm(get Getter, time Timer) { self.Dedup(get, time, ExpireNever{}) }
+
+/*
+Populates the cache exactly once for the lifetime of this `Mem`, ignoring
+expiration entirely. The first call invokes the getter and the timer under the
+write lock, and stores the result, even if it's an error. Concurrent callers
+wait for it. All later calls return the stored state without invoking the
+getter, and without retrying errors. Like `sync.Once`, but caches the result.
+
+The guard is independent of the stored state: other writes, such as
+`.SetTimed` or `.Zero`, replace the state returned by later calls, but don't
+cause the getter to run again.
+*/
+func (self *Mem) DedupOnce(get Getter, time Timer) Timed {
+	if atomic.LoadUint32(&self.once) == 1 {
+		return self.GetTimed()
+	}
+
+	self.wlock()
+	defer self.unlock()
+
+	if self.once == 1 {
+		return self.GetTimed()
+	}
+	defer atomic.StoreUint32(&self.once, 1)
+	return self.regen(get, time)
+}
+
+/*
+Variant of `.Dedup` that takes plain funcs instead of `Getter` and `Timer`,
+adapting them via `GetterFunc` and `TimerFunc` without allocating. Nil funcs
+behave like nil getters and timers.
+*/
+func (self *Mem) DedupFunc(get func() interface{}, time func() time.Time, exp Expirer) Timed {
+	return self.Dedup(GetterFunc(get), TimerFunc(time), exp)
+}
+
+/*
+Shorthand for `.Dedup(get, time, exp).Unwrap()`. Returns the resulting inner
+value and error as an idiomatic Go pair, dropping the timestamp. Caching
+behaves exactly like in `.Dedup`.
+*/
+func (self *Mem) DedupE(get Getter, time Timer, exp Expirer) (interface{}, error) {
+	return self.Dedup(get, time, exp).Unwrap()
+}
+
+/*
+Variant of `.Dedup` that checks expiration at the given fixed "now", via
+`IsExpiredAt`. Expirers that implement `ExpirerAt` see the provided time instead
+of the real clock. Other expirers are called as usual. Useful for deterministic
+tests without a stored `Clock`. Doesn't affect the timer.
+*/
+func (self *Mem) DedupAt(now time.Time, get Getter, time Timer, exp Expirer) Timed {
+	return self.Dedup(get, time, expirerAt{exp, now})
+}
+
+type expirerAt struct {
+	exp Expirer
+	now time.Time
+}
+
+func (self expirerAt) IsExpired(val Timed) bool {
+	return IsExpiredAt(self.exp, val, self.now)
+}
+
+/*
+Variant of `.Dedup` that applies the provided function to the freshly fetched
+value before storing it. The function runs only on the regeneration path, once
+per regeneration, never on cache hits. Errors bypass the function and are stored
+as-is. Panics in the function are caught and stored, just like panics in the
+getter. Nil function is equivalent to `.Dedup`.
+*/
+func (self *Mem) DedupMap(get Getter, time Timer, exp Expirer, fun func(interface{}) interface{}) Timed {
+	if fun == nil {
+		return self.Dedup(get, time, exp)
+	}
+	return self.Dedup(mapGetter{get, fun}, time, exp)
+}
+
+/*
+Variant of `.Dedup` that passes the given argument to the getter, for
+request-scoped data such as a tenant id, without allocating a closure per call.
+The getter is called only on the regeneration path. Cache hits don't allocate,
+as long as converting the argument to `interface{}` doesn't, for example for
+pointers. Nil getter is equivalent to a getter returning nil.
+
+Because of deduplication, when multiple callers with different arguments race
+to regenerate the same value, only the argument of the caller that acquires the
+write lock first "wins", and the others reuse its result. A `Mem` should cache
+only values that are equivalent for all arguments passed to it; for values that
+depend on the argument, use a separate `Mem` per argument, for example via
+`Map`.
+*/
+func (self *Mem) DedupArg(arg interface{}, get func(interface{}) interface{}, time Timer, exp Expirer) Timed {
+	// Avoids converting the getter to an interface, which allocates, on cache
+	// hits.
+	val := self.GetTimed()
+	if !IsExpired(exp, val) {
+		return val
+	}
+	return self.Dedup(argGetter{arg, get}, time, exp)
+}
+
+type argGetter struct {
+	arg interface{}
+	fun func(interface{}) interface{}
+}
+
+func (self argGetter) Get() interface{} {
+	if self.fun == nil {
+		return nil
+	}
+	return self.fun(self.arg)
+}
+
+/*
+Variant of `.Dedup` where the getter determines the expiration of its own
+value. The deadline returned by the getter is stored as `Timed.Time`, which,
+like with `DeadlineTimer`, means "valid until" rather than "fetched at". Pair
+it with `NowExpirer`, which expires values once the current time passes their
+timestamp, or with an `ExpirerOr` of `NowExpirer` and other conditions. Don't
+pair it with age-based expirers such as `Duration`.
+
+If the getter panics, the stored timestamp is zero, so with `NowExpirer` the
+error is retried on the next call. Nil getter is equivalent to a getter
+returning nil and the zero time. Cache hits don't allocate.
+*/
+func (self *Mem) DedupExpiring(get ExpiringGetter, exp Expirer) Timed {
+	// Avoids allocating the adapter on cache hits.
+	val := self.GetTimed()
+	if !IsExpired(exp, val) {
+		return val
+	}
+
+	tar := &expiringGetter{get: get}
+	return self.Dedup(tar, tar, exp)
+}
+
+/*
+Adapts `ExpiringGetter` to `Getter` and `Timer`. Relies on the fact that the
+timer is called after the getter, on the same goroutine.
+*/
+type expiringGetter struct {
+	get  ExpiringGetter
+	inst time.Time
+}
+
+func (self *expiringGetter) Get() interface{} {
+	if self.get == nil {
+		return nil
+	}
+	val, inst := self.get.GetExpiring()
+	self.inst = inst
+	return val
+}
+
+func (self *expiringGetter) Time() time.Time { return self.inst }
+
+/*
+Variant of `.Dedup` that invokes the provided hooks. `Hooks.OnHit` is invoked
+when the cached value is reused, either on the fast path or after re-checking
+under the write lock. `Hooks.OnMiss` is invoked after regenerating the value,
+and only for the goroutine that actually regenerated it, not for readers that
+waited behind it. Both are invoked after releasing the lock. Nil callbacks are
+ignored.
+*/
+func (self *Mem) DedupHooked(get Getter, time Timer, exp Expirer, hooks Hooks) Timed {
+	val, regen := self.dedup(get, time, exp)
+	if regen {
+		hooks.miss(val)
+	} else {
+		hooks.hit(val)
+	}
+	return val
+}
+
+/*
+Shared implementation of `.Dedup` and some of its variants. The boolean is true
+if the value was regenerated by this call.
+*/
+func (self *Mem) dedup(get Getter, time Timer, exp Expirer) (Timed, bool) {
+	val := self.GetTimed()
+	if !IsExpired(exp, val) {
+		return val, false
+	}
+	return self.dedupSlow(get, time, exp)
+}
+
+/*
+Slow path of `.dedup`, for callers that have already checked the current value
+and found it expired.
+*/
+func (self *Mem) dedupSlow(get Getter, time Timer, exp Expirer) (Timed, bool) {
+	// When multiple goroutines simultaneously try to acquire this lock, one
+	// succeeds immediately and proceeds to make a new value, while others
+	// succeed later.
+	self.wlock()
+	defer self.unlock()
+
+	// We must re-check expiration, because while we were acquiring the write
+	// lock, countless other writers may have done it first, regenerating the
+	// value.
+	val := self.GetTimed()
+	if !IsExpired(exp, val) {
+		return val, false
+	}
+
+	return self.regen(get, time), true
+}
+
+/*
+Unconditionally regenerates the value, ignoring expiration. Takes the write
+lock, calls the getter and timer, stores the result, and returns it. Unlike
+`.Zero` followed by `.Dedup`, there is no window in which other readers could
+observe the zero state.
+*/
+func (self *Mem) Refresh(get Getter, time Timer) Timed {
+	self.wlock()
+	defer self.unlock()
+	return self.regen(get, time)
+}
+
+/*
+Same as `.Refresh`, but also returns the previous state. Both happen
+atomically under the write lock: the returned previous state is exactly the
+state that was replaced, and no other write happens in between. Useful when
+the cached value owns resources, such as files or connections, which the
+caller must release after replacing it.
+*/
+func (self *Mem) Replace(get Getter, time Timer) (prev, next Timed) {
+	self.wlock()
+	defer self.unlock()
+	prev = self.GetTimed()
+	next = self.regen(get, time)
+	return
+}
+
+/*
+Starts a background goroutine that calls `.Refresh` every `interval`, keeping
+the cache warm independently of reads. The first refresh happens after the
+first interval; use `.Warm` or `.Refresh` to populate the cache immediately.
+Errors are stored like in any other regeneration. Readers use the cache as
+usual, for example via `.Dedup` with an expirer longer than the interval.
+
+Returns a function that stops the goroutine and waits for it to exit, including
+any refresh in progress. After it returns, no more refreshes happen. Calling it
+more than once is ok. Non-positive interval panics, like `time.NewTicker`.
+*/
+func (self *Mem) StartRefresher(interval time.Duration, get Getter, time Timer) (stop func()) {
+	return startLoop(interval, func() { self.Refresh(get, time) })
+}
+
+func startLoop(interval time.Duration, fun func()) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				fun()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-exited
+	}
+}
+
+/*
+Asynchronous variant of `.Dedup`. Returns a channel with a buffer of 1, which
+receives exactly one result, and is then closed. If the current value is fresh,
+the result is delivered immediately, without spawning a goroutine. Otherwise,
+`.Dedup` runs on a new goroutine, which exits as soon as the result is
+delivered. Because the channel is buffered, the goroutine doesn't leak even if
+the caller never reads from the channel, as long as the getter eventually
+returns.
+*/
+func (self *Mem) DedupAsync(get Getter, time Timer, exp Expirer) <-chan Timed {
+	out := make(chan Timed, 1)
+
+	val := self.GetTimed()
+	if !IsExpired(exp, val) {
+		out <- val
+		close(out)
+		return out
+	}
+
+	go func() {
+		defer close(out)
+		out <- self.Dedup(get, time, exp)
+	}()
+	return out
+}
+
+/*
+Same as `.Dedup`. Formerly a variant that didn't block readers which consider
+the current value fresh while another writer was regenerating it. Since reads
+became lock-free, `.Dedup` itself behaves this way.
+*/
+func (self *Mem) DedupNonBlockingFresh(get Getter, time Timer, exp Expirer) Timed {
+	return self.Dedup(get, time, exp)
+}
+
+/*
+Variant of `.Dedup` that respects context cancelation. If the context is
+canceled while waiting for the lock, for example while another writer is
+regenerating the value, returns `(Timed{}, ctx.Err())` without waiting further.
+If the context is canceled by the time this call acquires the write lock, the
+getter is not called. However, a getter already in progress is not interrupted
+and still completes, storing its result.
+
+When the current value is fresh, this doesn't spawn any goroutines. Otherwise,
+waiting is done on a separate goroutine, which makes this more expensive than
+`.Dedup`.
+*/
+func (self *Mem) DedupCtx(ctx context.Context, get Getter, time Timer, exp Expirer) (Timed, error) {
+	err := ctx.Err()
+	if err != nil {
+		return Timed{}, err
+	}
+
+	val := self.GetTimed()
+	if !IsExpired(exp, val) {
+		return val, nil
+	}
+
+	out := make(chan Timed, 1)
+	go self.dedupDone(ctx.Done(), get, time, exp, out)
+
+	select {
+	case val := <-out:
+		return val, nil
+	case <-ctx.Done():
+		return Timed{}, ctx.Err()
+	}
+}
+
+/*
+Variant of `.Dedup` that stops waiting when the given channel is closed, as a
+lighter alternative to `.DedupCtx`. Returns the result and true if the dedup
+completed, or `(Timed{}, false)` if `done` was closed first, for example while
+waiting for another writer. If `done` is already closed, returns immediately.
+If `done` is closed by the time this call acquires the write lock, the getter
+is not called. However, a getter already in progress, including one owned by
+this call, is not interrupted and still completes, storing its result. Nil
+`done` is never closed, making this equivalent to `.Dedup`.
+
+Has the same performance characteristics as `.DedupCtx`.
+*/
+func (self *Mem) DedupDone(done <-chan struct{}, get Getter, time Timer, exp Expirer) (Timed, bool) {
+	if isClosed(done) {
+		return Timed{}, false
+	}
+
+	val := self.GetTimed()
+	if !IsExpired(exp, val) {
+		return val, true
+	}
+
+	out := make(chan Timed, 1)
+	go self.dedupDone(done, get, time, exp, out)
+
+	select {
+	case val := <-out:
+		return val, true
+	case <-done:
+		return Timed{}, false
+	}
+}
+
+func (self *Mem) dedupDone(done <-chan struct{}, get Getter, time Timer, exp Expirer, out chan<- Timed) {
+	val := self.GetTimed()
+	if !IsExpired(exp, val) {
+		out <- val
+		return
+	}
+
+	self.wlock()
+	defer self.unlock()
+
+	// The caller is no longer waiting, and nobody needs the new value yet.
+	if isClosed(done) {
+		return
+	}
+
+	val = self.GetTimed()
+	if !IsExpired(exp, val) {
+		out <- val
+		return
+	}
+
+	out <- self.regen(get, time)
+}
+
+/*
+Variant of `.Dedup` with a time limit on the whole operation, including waiting
+for another writer and running the getter. If it doesn't finish within the
+given duration, returns `(Timed{}, ErrTimeout)`. Simpler than `.DedupCtx` when
+there's no context to plumb through. Unlike `.DedupCtx`, a timed-out call
+still proceeds in the background: a late getter result still populates the
+cache, and is available to later calls. Zero or negative duration disables the
+timeout.
+
+When the current value is fresh, this doesn't spawn any goroutines. Otherwise,
+the dedup runs on a separate goroutine, which makes this more expensive than
+`.Dedup`.
+*/
+func (self *Mem) DedupWithTimeout(dur time.Duration, get Getter, time Timer, exp Expirer) (Timed, error) {
+	if dur <= 0 {
+		return self.Dedup(get, time, exp), nil
+	}
+
+	val := self.GetTimed()
+	if !IsExpired(exp, val) {
+		return val, nil
+	}
+
+	// Buffered, so that a late dedup doesn't block forever.
+	out := make(chan Timed, 1)
+	go func() { out <- self.Dedup(get, time, exp) }()
+	return awaitTimed(dur, out)
+}
+
+// Non-blocking check. Nil channel is never closed.
+func isClosed(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+func awaitTimed(dur time.Duration, out <-chan Timed) (Timed, error) {
+	timer := time.NewTimer(dur)
+	defer timer.Stop()
+
+	select {
+	case val := <-out:
+		return val, nil
+	case <-timer.C:
+		return Timed{}, ErrTimeout
+	}
+}
+
+/*
+Variant of `.Dedup` that doesn't cache errors. If the regenerated value is an
+error (see `Either.Unwrap`), returns it, but resets the stored state to
+`Timed{}`, so the next call retries. Non-error values are cached normally.
+Readers that were waiting behind the failing writer re-check the expiration of
+the zero state, which is usually expired, and retry as well.
+*/
+func (self *Mem) DedupRetryErr(get Getter, time Timer, exp Expirer) Timed {
+	val := self.GetTimed()
+	if !IsExpired(exp, val) {
+		return val
+	}
+
+	self.wlock()
+	defer self.unlock()
+
+	val = self.GetTimed()
+	if !IsExpired(exp, val) {
+		return val
+	}
+
+	val = self.produce(val, get, time)
+
+	_, err := val.Unwrap()
+	if err != nil {
+		self.store(Timed{})
+	} else {
+		self.store(val)
+	}
+	return val
+}
+
+/*
+Variant of `.Dedup` that serves the last good value when a refresh fails. When
+the current value is expired, regenerates it. If the new value is an error, and
+the previous state holds a non-error value and is non-zero, keeps
+the previous state, including its timestamp, and returns it instead of the
+error. Because the timestamp is retained, the previous value usually remains
+expired, and the next call retries the refresh. If there's no previous good
+value, the error is stored and returned as usual.
+*/
+func (self *Mem) DedupFallbackStale(get Getter, time Timer, exp Expirer) Timed {
+	val := self.GetTimed()
+	if !IsExpired(exp, val) {
+		return val
+	}
+
+	self.wlock()
+	defer self.unlock()
+
+	val = self.GetTimed()
+	if !IsExpired(exp, val) {
+		return val
+	}
+
+	next := self.produce(val, get, time)
+
+	if isErr(next.Either[0]) && !val.IsZero() && !isErr(val.Either[0]) {
+		return val
+	}
+
+	self.store(next)
+	return next
+}
+
+/*
+Variant of `.Dedup` that avoids rewriting the state when the regenerated value
+is equal to the previous one. When the current value is expired, regenerates
+it, and compares the old and new inner values via the given function. If they
+are equal, keeps the previous state, including its timestamp, and returns it
+without writing, so `.Generation` doesn't change. Because the timestamp is not
+refreshed, the previous value usually remains expired, and the next call
+regenerates again. Otherwise, stores and returns the new value. Nil function
+falls back on `reflect.DeepEqual`.
+*/
+func (self *Mem) DedupIfChanged(get Getter, time Timer, exp Expirer, eq func(a, b interface{}) bool) Timed {
+	val := self.GetTimed()
+	if !IsExpired(exp, val) {
+		return val
+	}
+
+	self.wlock()
+	defer self.unlock()
+
+	val = self.GetTimed()
+	if !IsExpired(exp, val) {
+		return val
+	}
+
+	next := self.produce(val, get, time)
+
+	if eq == nil {
+		eq = reflect.DeepEqual
+	}
+	if eq(val.Either[0], next.Either[0]) {
+		return val
+	}
+
+	self.store(next)
+	return next
+}
+
+/*
+Stale-while-revalidate variant of `.Dedup`. If the current value is fresh,
+returns it as-is. If the current value is expired but non-zero, returns the
+stale value immediately, and regenerates it on a background goroutine. Only one
+background refresh runs at a time; while it runs, all callers keep getting the
+stale value. The background refresh calls the getter without holding the lock,
+and stores the result via `.SetTimed`, so it never blocks readers.
+
+When the current value is zero, with nil value and zero timestamp, there is
+nothing to serve, so this blocks just like `.Dedup`.
+*/
+func (self *Mem) DedupStale(get Getter, time Timer, exp Expirer) Timed {
+	val := self.GetTimed()
+	if !IsExpired(exp, val) {
+		return val
+	}
+
+	if val.IsZero() {
+		return self.Dedup(get, time, exp)
+	}
+
+	if atomic.CompareAndSwapUint32(&self.stale, 0, 1) {
+		go self.refreshStale(get, time)
+	}
+	return val
+}
+
+/*
+Three-tier variant of `.DedupStale`, using the policy described by `Tiered`.
+Fresh values are returned as-is. Stale values are returned immediately, and
+regenerated on a background goroutine, using the same machinery as
+`.DedupStale`. Dead values, including the zero state, are regenerated while
+blocking, just like in `.Dedup`.
+*/
+func (self *Mem) DedupTiered(get Getter, time Timer, tier Tiered) Timed {
+	val := self.GetTimed()
+	if tier.IsExpired(val) {
+		return self.Dedup(get, time, tier)
+	}
+
+	if tier.IsStale(val) && atomic.CompareAndSwapUint32(&self.stale, 0, 1) {
+		go self.refreshStale(get, time)
+	}
+	return val
+}
+
+func (self *Mem) refreshStale(get Getter, time Timer) {
+	defer atomic.StoreUint32(&self.stale, 0)
+
+	var val Timed
+	val.SetGetter(get)
+	val.SetTimer(time)
+	self.SetTimed(val)
+}
+
+// Must be called under the write lock.
+func (self *Mem) regen(get Getter, time Timer) Timed {
+	val := self.produce(self.GetTimed(), get, time)
+	self.store(val)
+	return val
+}
+
+/*
+Panic value used when a getter or timer, running under the write lock of a
+`Mem`, calls back into the same `Mem` in a way that would wait for that lock,
+which would otherwise deadlock, because `sync.Mutex` is not reentrant. Since
+getter panics are caught and stored, this usually ends up as the cached error
+of the outer call. Used only when enabled via `(*Mem).SetDetectReentrancy`.
+*/
+var ErrReentrant = errors.New(
+	`[ded] reentrant Dedup on ded.Mem: a getter or timer called back into ` +
+		`the same Mem while it holds the write lock`,
+)
+
+/*
+Must be called under the write lock. Calls the getter and the timer. When
+reentrancy detection is enabled, records the current goroutine as the writer,
+for the check in `.wlock`.
+*/
+func (self *Mem) produce(val Timed, get Getter, time Timer) Timed {
+	if self.detect {
+		self.writer.Store(goid())
+		defer self.writer.Store(0)
+	}
+
+	val.SetGetter(get)
+	val.SetTimer(time)
+	return val
+}
+
+/*
+Same as `self.lock.Lock`, but panics with `ErrReentrant` instead of deadlocking
+when called by a getter or timer that runs under the write lock of the same
+`Mem`. The check happens only when the lock is unavailable, so uncontended
+writes don't pay for it.
+*/
+func (self *Mem) wlock() {
+	if !self.lock.TryLock() {
+		self.checkReentrant()
+		self.lock.Lock()
+	}
+}
+
+func (self *Mem) checkReentrant() {
+	writer := self.writer.Load()
+	if writer != 0 && writer == goid() {
+		panic(ErrReentrant)
+	}
+}
+
+/*
+Returns the id of the current goroutine, parsed from the header of
+`runtime.Stack`, which looks like "goroutine 123 [running]:". Go deliberately
+doesn't expose goroutine ids; this is used only for reentrancy detection.
+*/
+func goid() uint64 {
+	var buf [32]byte
+	src := buf[:runtime.Stack(buf[:], false)]
+	src = bytes.TrimPrefix(src, []byte(`goroutine `))
+
+	var out uint64
+	for _, char := range src {
+		if char < '0' || char > '9' {
+			break
+		}
+		out = out*10 + uint64(char-'0')
+	}
+	return out
+}
+
+/*
+Must be called under the write lock. All writes go through this method, which
+publishes the new state to readers, increments the generation reported by
+`.Generation`, delivers the new state to subscribers registered via
+`.Subscribe`, and prepares the notification for the listener set by
+`.SetListener`, which is delivered by `.unlock`.
+*/
+func (self *Mem) store(val Timed) {
+	if self.listener != nil {
+		self.pend = &memTransition{self.GetTimed(), val}
+	}
+	self.ptr.Store(&val)
+	self.gen.Add(1)
+
+	for sub := range self.subs {
+		sub.send(val)
+	}
+}
+
+/*
+Releases the write lock, then notifies the listener about the write performed
+under the lock, if any. Must be used instead of `self.lock.Unlock` by methods
+that write.
 */
-func NewMem(val Timed) *Mem { return &Mem{val: val} }
+func (self *Mem) unlock() {
+	fun, pend := self.listener, self.pend
+	self.pend = nil
+	self.lock.Unlock()
 
-/*
-Tool for deduplicating data-fetching operations. The zero value is ready to use,
-but must not be copied (use it by pointer). Conceptually, this is something
-like `atomic.Value<Timed>`, with the added ability to synchronize readers with
-writers, and to avoid generating new states when the value is not expired.
+	if pend != nil {
+		fun(pend.prev, pend.next)
+	}
+}
 
-Intended for simultaneous use by many concurrent readers. As such, all methods
-of `*Mem` are concurrency-safe.
+type memTransition struct{ prev, next Timed }
+
+type memSub struct{ out chan Timed }
+
+/*
+Non-blocking send that replaces the pending value, if any. Must be called under
+the write lock of the owning `Mem`, which guarantees a single sender, so the
+loop terminates as soon as the buffer is free.
 */
-type Mem struct {
-	lock sync.RWMutex
-	val  Timed
+func (self *memSub) send(val Timed) {
+	for {
+		select {
+		case self.out <- val:
+			return
+		default:
+		}
+
+		select {
+		case <-self.out:
+		default:
+		}
+	}
+}
+
+// Implement `fmt.GoStringer` for debug purposes.
+func (self *Mem) GoString() string {
+	return fmt.Sprintf(`ded.NewMem(%#v)`, self.GetTimed())
 }
 
 /*
-Shorthand for `.GetTimed().Get()`. Returns the currently-cached inner value,
-which is initially nil. If an error is currently cached, panics with that
-error. If a writer is currently generating a new value, this blocks until the
-writer is finished, returning the new value.
+Implement `gob.GobEncoder` by encoding the current state, including the
+timestamp. Because the inner value is `interface{}`, gob requires its concrete
+type to be registered via `gob.Register`. This also applies to errors: common
+error types, such as those made by `errors.New`, have no exported fields and
+can't be encoded, so cached errors should use a custom registered type.
 */
-func (self *Mem) Get() interface{} { return self.GetTimed().Get() }
+func (self *Mem) GobEncode() ([]byte, error) {
+	val := self.GetTimed()
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(gobTimed{val.Either[0], val.Time})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
 /*
-Returns the currently-cached state. Initially this returns the zero value
-`Timed{}`. If a writer is currently generating a new value, this blocks until
-the writer is finished, returning the new state.
+Implement `gob.GobDecoder` by decoding the state previously encoded by
+`.GobEncode` and storing it via `.SetTimed`. See `.GobEncode` for the
+requirements.
 */
-func (self *Mem) GetTimed() Timed {
-	self.lock.RLock()
-	defer self.lock.RUnlock()
-	return self.val
+func (self *Mem) GobDecode(src []byte) error {
+	var val gobTimed
+	err := gob.NewDecoder(bytes.NewReader(src)).Decode(&val)
+	if err != nil {
+		return err
+	}
+
+	self.SetTimed(MakeTimed(val.Val, val.Time))
+	return nil
 }
 
-// Replaces the cached state with the provided state.
-func (self *Mem) SetTimed(val Timed) {
-	self.lock.Lock()
-	defer self.lock.Unlock()
-	self.val = val
+type gobTimed struct {
+	Val  interface{}
+	Time time.Time
 }
 
-// Zeroes the state, resetting it to `Timed{}`.
-func (self *Mem) Zero() { self.SetTimed(Timed{}) }
+// Snapshot of cache counters collected by `MeteredMem`.
+type Stats struct {
+	Hits   int64
+	Misses int64
+	Errors int64
+}
 
 /*
-Main API of this package. Uses the provided expirer to determine the freshness
-of the currently-stored value. If fresh enough, returns the value as-is.
-Otherwise, uses the provided getter and timer to generate a new value with its
-timestamp, and returns the new result.
+Variant of `Mem` that counts cache hits, misses, and errors, which can be polled
+via `.Stats`. Must be used by pointer. Only calls to `(*MeteredMem).Dedup` are
+counted. Compare `Hooks`, which provides callbacks instead of counters.
+*/
+type MeteredMem struct {
+	// Must be first, for 64-bit alignment of atomic operations on 32-bit
+	// platforms.
+	stats Stats
+	Mem
+}
 
-Uses `sync.RWMutex` to synchronize access. Concurrent readers don't block each
-other. Writers block everyone else. The provided getter is assumed to be slow
-and expensive. Only the writer holding the write lock is allowed to regenerate
-the value by calling the getter.
+/*
+Same as `(*Mem).Dedup`, but also updates the counters. Increments `Hits` when
+the cached value is reused, and `Misses` when the value is regenerated. When the
+regenerated value is an error, also increments `Errors`.
 */
-func (self *Mem) Dedup(get Getter, time Timer, exp Expirer) Timed {
-	val := self.GetTimed()
-	if !IsExpired(exp, val) {
-		return val
+func (self *MeteredMem) Dedup(get Getter, time Timer, exp Expirer) Timed {
+	val, regen := self.Mem.DedupReport(get, time, exp)
+	if regen {
+		atomic.AddInt64(&self.stats.Misses, 1)
+		if isErr(val.Either[0]) {
+			atomic.AddInt64(&self.stats.Errors, 1)
+		}
+	} else {
+		atomic.AddInt64(&self.stats.Hits, 1)
 	}
+	return val
+}
 
-	// When multiple goroutines simultaneously try to acquire this lock, one
-	// succeeds immediately and proceeds to make a new value, while others
-	// succeed later.
-	self.lock.Lock()
-	defer self.lock.Unlock()
+// Returns a snapshot of the counters, using atomic loads.
+func (self *MeteredMem) Stats() Stats {
+	return Stats{
+		Hits:   atomic.LoadInt64(&self.stats.Hits),
+		Misses: atomic.LoadInt64(&self.stats.Misses),
+		Errors: atomic.LoadInt64(&self.stats.Errors),
+	}
+}
 
-	// We must re-check expiration, because while we were acquiring the write
-	// lock, countless other writers may have done it first, regenerating the
-	// value.
-	val = self.val
-	if !IsExpired(exp, val) {
+type mapGetter struct {
+	get Getter
+	fun func(interface{}) interface{}
+}
+
+func (self mapGetter) Get() interface{} {
+	val := Get(self.get)
+	if isErr(val) {
 		return val
 	}
+	return self.fun(val)
+}
 
-	self.val.SetGetter(get)
-	self.val.SetTimer(time)
-	return self.val
+func isErr(val interface{}) bool {
+	_, ok := val.(error)
+	return ok
 }
 
-// Implement `fmt.GoStringer` for debug purposes.
-func (self *Mem) GoString() string {
-	return fmt.Sprintf(`ded.NewMem(%#v)`, self.GetTimed())
+/*
+Optional callbacks for `(*Mem).DedupHooked`, for example for collecting cache
+metrics. Nil callbacks are ignored.
+*/
+type Hooks struct {
+	OnHit  func(Timed)
+	OnMiss func(Timed)
+}
+
+func (self Hooks) hit(val Timed) {
+	if self.OnHit != nil {
+		self.OnHit(val)
+	}
+}
+
+func (self Hooks) miss(val Timed) {
+	if self.OnMiss != nil {
+		self.OnMiss(val)
+	}
+}
+
+type elapsedGetter struct {
+	get Getter
+	out *time.Duration
 }
 
+func (self elapsedGetter) Get() interface{} {
+	defer measure(self.out, time.Now())
+	return Get(self.get)
+}
+
+func measure(out *time.Duration, start time.Time) { *out = time.Since(start) }
+
 // Same as `val.Get()` but nil-safe. Fallback output is nil.
 func Get(val Getter) interface{} {
 	if val != nil {
-		return val
+		return val.Get()
 	}
 	return nil
 }
 
+/*
+Non-panicking variant of `Get`. Nil getter returns `(nil, nil)`. If the getter
+implements `Unwrap() (interface{}, error)`, like `Either` and `Timed`, uses that
+method. Otherwise calls `.Get()`, recovering any panic and returning it as an
+error. Non-error panic values are wrapped in `*PanicError`. Just like in
+`Either`, an `error` result is returned as an error.
+*/
+func GetErr(val Getter) (out interface{}, err error) {
+	if val == nil {
+		return nil, nil
+	}
+
+	impl, _ := val.(interface{ Unwrap() (interface{}, error) })
+	if impl != nil {
+		return impl.Unwrap()
+	}
+
+	defer recErr(&err)
+	return Either{val.Get()}.Unwrap()
+}
+
 // Same as `val.Get()` but nil-safe. Fallback output is `time.Time{}`.
 func Time(val Timer) time.Time {
 	if val != nil {
@@ -174,6 +1408,19 @@ func IsExpired(exp Expirer, timed Timed) bool {
 	return exp == nil || exp.IsExpired(timed)
 }
 
+/*
+Variant of `IsExpired` that injects the given "now". If the expirer implements
+`ExpirerAt`, calls `.IsExpiredAt(timed, now)`. Otherwise falls back on
+`.IsExpired`, which may use the real clock. Nil expirer is always expired.
+*/
+func IsExpiredAt(exp Expirer, timed Timed, now time.Time) bool {
+	impl, _ := exp.(ExpirerAt)
+	if impl != nil {
+		return impl.IsExpiredAt(timed, now)
+	}
+	return IsExpired(exp, timed)
+}
+
 /*
 Same as `val.Dedup(val, val, val)`. Shorthand for types that combine all
 relevant methods into one by embedding `Mem` and other types such as `NowTimer`
@@ -187,11 +1434,101 @@ func Dedup(val Omni) Timed {
 	return Timed{}
 }
 
+/*
+Same as `val.Dedup(val, val, exp)`. Variant of `Dedup` that reuses the getter
+and timer of the given `Omni`, but overrides its expiration policy for this
+call. For example, `Void{}` forces a refresh, and a long `Duration` reuses the
+cached value even when the embedded expirer considers it expired. Nil `Omni`
+returns `Timed{}`, consistent with `Dedup`. Nil expirer always expires, like in
+`Mem.Dedup`.
+*/
+func WithExpirer(val Omni, exp Expirer) Timed {
+	if val != nil {
+		return val.Dedup(val, val, exp)
+	}
+	return Timed{}
+}
+
+/*
+Package-wide default expirer used by `DedupWithDefault`. Allows apps to
+centralize their TTL policy in one place. Not synchronized: should be set
+during initialization, before any concurrent use. Nil means always expired,
+just like a nil expirer passed to `Mem.Dedup`.
+*/
+var DefaultExpirer Expirer = ExpireMinute{}
+
+/*
+Same as `mem.Dedup(get, time, DefaultExpirer)`. Nil mem returns `Timed{}`,
+consistent with `Dedup`.
+*/
+func DedupWithDefault(mem *Mem, get Getter, time Timer) Timed {
+	if mem != nil {
+		return mem.Dedup(get, time, DefaultExpirer)
+	}
+	return Timed{}
+}
+
+/*
+Calls `Dedup` on each of the provided values concurrently, one goroutine per
+value, and returns the results in the same order. Nil entries produce `Timed{}`,
+consistent with `Dedup`. Returns after all calls are done.
+*/
+func DedupAll(vals ...Omni) []Timed {
+	if len(vals) == 0 {
+		return nil
+	}
+
+	out := make([]Timed, len(vals))
+	var wg sync.WaitGroup
+
+	for i, val := range vals {
+		if val == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(index int, val Omni) {
+			defer wg.Done()
+			out[index] = Dedup(val)
+		}(i, val)
+	}
+
+	wg.Wait()
+	return out
+}
+
+/*
+Shortcut for one-off caches. Returns a ready-to-use `Omni` backed by its own
+`Mem`, which calls the given function as its getter, uses `NowTimer` for
+timestamps, and the given expirer for expiration. Avoids defining a type that
+embeds `Mem`, `NowTimer` and an expirer. Pass the result to `Dedup`. Nil
+function is equivalent to a nil getter. Nil expirer means the value is always
+expired, just like in `Mem.Dedup`. Safe for concurrent use.
+*/
+func NewOmni(get func() interface{}, exp Expirer) Omni {
+	return &omni{get: get, exp: exp}
+}
+
+type omni struct {
+	Mem
+	NowTimer
+	get GetterFunc
+	exp Expirer
+}
+
+func (self *omni) Get() interface{} { return self.get.Get() }
+
+func (self *omni) IsExpired(val Timed) bool { return IsExpired(self.exp, val) }
+
 /*
 Represents either value or error. If the inner value implements `error`,
 unwrapping with `.Get()` will panic. Supports "set"-style methods that catch
 and store panics. Currently uses only one `interface{}` field to avoid wasting
 memory. The representation may change in future versions.
+
+Comparing `Either` or `Timed` via `==` compares the inner `interface{}` values,
+which panics at runtime when they hold non-comparable types such as slices or
+maps. Use `.Equal` when the contents may be non-comparable.
 */
 type Either [1]interface{}
 
@@ -223,11 +1560,18 @@ func (self Either) Unwrap() (interface{}, error) {
 // Replaces the inner value.
 func (self *Either) Set(val interface{}) { self[0] = val }
 
+/*
+True if the inner values are deeply equal, via `reflect.DeepEqual`. Unlike
+`==`, never panics, even for non-comparable inner values.
+*/
+func (self Either) Equal(val Either) bool { return reflect.DeepEqual(self[0], val[0]) }
+
 /*
 Replaces the inner value by calling the provided getter. Nil getter is ok and
 considered to have nil value. If the getter panics, the panic is caught and
-stored as inner value. Later, attempting to `.Get()` a caught error will
-panic.
+stored as inner value. Errors are stored as-is, while other panic values, such
+as strings, are wrapped in `*PanicError`, which records the stack trace. Later,
+attempting to `.Get()` a caught panic will panic with the stored error.
 */
 func (self *Either) SetGetter(val Getter) {
 	if val == nil {
@@ -239,6 +1583,59 @@ func (self *Either) SetGetter(val Getter) {
 	self.Set(val.Get())
 }
 
+/*
+Transforms the inner value via the given function, unless it's an error, in
+which case returns the `Either` unchanged. Like `Result.map` in other
+languages. If the function panics, the panic is caught and stored, just like in
+`.SetGetter`, so any panic makes the result an error. Nil function
+returns the `Either` unchanged.
+*/
+func (self Either) Map(fun func(interface{}) interface{}) (out Either) {
+	val, err := self.Unwrap()
+	if err != nil || fun == nil {
+		return self
+	}
+
+	defer out.rec()
+	out.Set(fun(val))
+	return
+}
+
+/*
+Chains a dependent fetch. If the inner value is an error, returns the `Either`
+unchanged. Otherwise calls the given function with the inner value to obtain
+the next getter, then calls that getter, just like `.SetGetter`, returning its
+result. Panics in either function are caught and stored. A nil getter produces
+nil, consistent with `.SetGetter`. Nil function returns the `Either` unchanged.
+*/
+func (self Either) Then(fun func(interface{}) Getter) (out Either) {
+	val, err := self.Unwrap()
+	if err != nil || fun == nil {
+		return self
+	}
+
+	defer out.rec()
+	out.SetGetter(fun(val))
+	return
+}
+
+/*
+Variant of `.SetGetter` that passes any caught panic through the given
+converter, storing the resulting error instead of the raw panic value. Useful
+for custom error types or messages. If the converter is nil or returns nil, the
+panic is stored just like in `.SetGetter`: errors as-is, other values wrapped
+in `*PanicError`.
+*/
+func (self *Either) SetGetterErr(val Getter, conv func(interface{}) error) {
+	if val == nil {
+		self.Set(nil)
+		return
+	}
+
+	defer self.recConv(conv)
+	self.Set(val.Get())
+}
+
 // Implement `fmt.GoStringer` for debug purposes.
 func (self Either) GoString() string {
 	return fmt.Sprintf(`ded.Either{%#v}`, self[0])
@@ -248,10 +1645,60 @@ func (self Either) GoString() string {
 func (self *Either) rec() {
 	val := recover()
 	if val != nil {
-		self.Set(val)
+		self.Set(toErr(val))
+	}
+}
+
+// Must be deferred.
+func (self *Either) recConv(conv func(interface{}) error) {
+	val := recover()
+	if val == nil {
+		return
+	}
+
+	if conv != nil {
+		err := conv(val)
+		if err != nil {
+			self.Set(err)
+			return
+		}
+	}
+	self.Set(toErr(val))
+}
+
+// Must be deferred.
+func recErr(ptr *error) {
+	val := recover()
+	if val != nil {
+		*ptr = toErr(val)
+	}
+}
+
+// Should be called while recovering, to capture the stack of the panic.
+func toErr(val interface{}) error {
+	err, _ := val.(error)
+	if err != nil {
+		return err
 	}
+	return &PanicError{val, debug.Stack()}
 }
 
+/*
+Error used for caught panics with non-error values, such as strings. Produced
+by `Either.SetGetter`, `Timed.SetTimer`, `GetErr` and other methods that catch
+panics, which store and return it like any other error. Panics with errors are
+not wrapped. `.Value` is the original panic value, and `.Stack` is the stack
+trace of the panicking goroutine at the time of recovery, as returned by
+`debug.Stack`, which includes the frames that panicked.
+*/
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+// Implement `error`, formatting the panic value via `fmt.Sprint`.
+func (self *PanicError) Error() string { return fmt.Sprint(self.Value) }
+
 // Shortcut for constructing `Timed`.
 func MakeTimed(val interface{}, inst time.Time) Timed {
 	return Timed{Either{val}, inst}
@@ -272,7 +1719,8 @@ type Timed struct {
 /*
 Replaces the timestamp by calling `val.Time()`. Nil timer is ok, equivalent to
 `time.Time{}`. If the timer panics, the resulting panic replaces the inner
-value stored in `.Either`, while the timestamp is unaffected.
+value stored in `.Either`, while the timestamp is unaffected. Panics are
+stored like in `Either.SetGetter`.
 */
 func (self *Timed) SetTimer(val Timer) {
 	if val == nil {
@@ -284,11 +1732,193 @@ func (self *Timed) SetTimer(val Timer) {
 	self.Time = val.Time()
 }
 
+// Returns a modified copy with the given inner value, keeping the timestamp.
+func (self Timed) WithValue(val interface{}) Timed {
+	self.Set(val)
+	return self
+}
+
+// Returns a modified copy with the given timestamp, keeping the inner value.
+func (self Timed) WithTime(inst time.Time) Timed {
+	self.Time = inst
+	return self
+}
+
+/*
+True if this is the zero value `Timed{}`: nil inner value and zero timestamp.
+This is the initial state of `Mem`, meaning nothing was ever cached. A `Timed`
+holding an error, or holding nil with a non-zero timestamp, is not zero.
+*/
+func (self Timed) IsZero() bool {
+	return self.Either[0] == nil && self.Time.IsZero()
+}
+
+// True if the inner value is non-nil and isn't an error.
+func (self Timed) HasValue() bool {
+	val := self.Either[0]
+	return val != nil && !isErr(val)
+}
+
+/*
+Returns the age of the timestamp relative to the given "now": `now - timestamp`.
+A timestamp in the future of `now` has a negative age. Because
+`time.Duration` can represent only about 292 years, the result saturates; in
+particular, the zero timestamp, which means "never fetched", always has the
+maximum age `time.Duration(math.MaxInt64)`, as if it were infinitely old.
+*/
+func (self Timed) Age(now time.Time) time.Duration {
+	if self.Time.IsZero() {
+		return math.MaxInt64
+	}
+	return now.Sub(self.Time)
+}
+
+/*
+Formats the timestamp for the HTTP `Last-Modified` header: RFC1123 in GMT, the
+same as `http.TimeFormat`. The zero timestamp produces an empty string, which
+means the header should be omitted.
+*/
+func (self Timed) LastModified() string {
+	if self.Time.IsZero() {
+		return ``
+	}
+	return self.Time.UTC().Format(httpTimeFormat)
+}
+
+// Same as `http.TimeFormat`, without importing "net/http".
+const httpTimeFormat = `Mon, 02 Jan 2006 15:04:05 GMT`
+
+/*
+Returns the number of whole seconds remaining until the value reaches the given
+TTL, relative to the given "now", suitable for the `max-age` directive of the
+HTTP `Cache-Control` header. Clamped at zero: expired values, and the zero
+timestamp, which has the maximum age (see `.Age`), return 0.
+*/
+func (self Timed) MaxAge(ttl time.Duration, now time.Time) int {
+	age := self.Age(now)
+	if age >= ttl {
+		return 0
+	}
+	return int((ttl - age) / time.Second)
+}
+
+/*
+True if both the inner values and the timestamps are equal. Inner values are
+compared via `Either.Equal`, which never panics. Timestamps are compared via
+`time.Time.Equal`, which compares instants: the same instant in different
+locations is equal, but any difference in the instant makes the `Timed` values
+unequal, even when the inner values are equal. To compare only the inner
+values, as `Mem.DedupIfChanged` does by default, use `Either.Equal`.
+*/
+func (self Timed) Equal(val Timed) bool {
+	return self.Time.Equal(val.Time) && self.Either.Equal(val.Either)
+}
+
+/*
+Returns a copy whose inner value doesn't share mutable memory with the
+original, protecting the cache from callers who mutate what they get. Slices
+and maps are copied recursively, via reflection, including slices and maps
+nested in slices, maps, arrays, and interface values. Other values, including
+errors, pass through as-is, without reflection.
+
+Limitations: pointers and channels are shared, not followed. Structs are copied
+by value, shallowly: slices, maps and pointers in struct fields are shared,
+because reflection can't set unexported fields. The cost is proportional to the
+size of the copied data, with an allocation per slice and map, which makes this
+unsuitable for hot paths with large values.
+*/
+func (self Timed) Copy() Timed {
+	self.Either[0] = deepCopy(self.Either[0])
+	return self
+}
+
+// Returns the stored error, if any. Shortcut for the error part of `.Unwrap`.
+func (self Timed) Err() error {
+	_, err := self.Unwrap()
+	return err
+}
+
+/*
+Implement `fmt.Stringer`. If an error is stored, returns its message. Otherwise
+formats the inner value via `fmt.Sprint`. The timestamp is omitted; use
+`.GoString` to include it.
+*/
+func (self Timed) String() string {
+	val, err := self.Unwrap()
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprint(val)
+}
+
 // Implement `fmt.GoStringer` for debug purposes.
 func (self Timed) GoString() string {
 	return fmt.Sprintf(`ded.MakeTimed(%#v, %#v)`, self.Either[0], self.Time)
 }
 
+func deepCopy(val interface{}) interface{} {
+	src := reflect.ValueOf(val)
+	if !isDeepKind(src.Kind()) {
+		return val
+	}
+	return copyValue(src).Interface()
+}
+
+func copyValue(src reflect.Value) reflect.Value {
+	switch src.Kind() {
+	case reflect.Slice:
+		if src.IsNil() {
+			return src
+		}
+		out := reflect.MakeSlice(src.Type(), src.Len(), src.Len())
+		if !isDeepKind(src.Type().Elem().Kind()) {
+			reflect.Copy(out, src)
+			return out
+		}
+		for ind := 0; ind < src.Len(); ind++ {
+			out.Index(ind).Set(copyValue(src.Index(ind)))
+		}
+		return out
+
+	case reflect.Map:
+		if src.IsNil() {
+			return src
+		}
+		out := reflect.MakeMapWithSize(src.Type(), src.Len())
+		iter := src.MapRange()
+		for iter.Next() {
+			out.SetMapIndex(iter.Key(), copyValue(iter.Value()))
+		}
+		return out
+
+	case reflect.Array:
+		out := reflect.New(src.Type()).Elem()
+		for ind := 0; ind < src.Len(); ind++ {
+			out.Index(ind).Set(copyValue(src.Index(ind)))
+		}
+		return out
+
+	case reflect.Interface:
+		if src.IsNil() {
+			return src
+		}
+		out := reflect.New(src.Type()).Elem()
+		out.Set(copyValue(src.Elem()))
+		return out
+
+	default:
+		return src
+	}
+}
+
+// Kinds which may contain slices or maps reachable by `copyValue`.
+func isDeepKind(kind reflect.Kind) bool {
+	return kind == reflect.Slice ||
+		kind == reflect.Map ||
+		kind == reflect.Array ||
+		kind == reflect.Interface
+}
+
 /*
 Implements `Expirer` like this: `time.Now() > (input + self)`. When duration is
 negative, only future timestamps can pass.
@@ -299,14 +1929,56 @@ allocating statically.
 */
 type Duration time.Duration
 
-var _ = Expirer(Duration(0))
+var (
+	_ = Expirer(Duration(0))
+	_ = ExpirerAt(Duration(0))
+)
+
+/*
+Returns an `Expirer` that expires values older than the given duration. This is
+the canonical way to express "expire N after fetch", and is equivalent to
+`Duration(dur)`. The returned interface conversion doesn't allocate on 64-bit
+machines.
+*/
+func ExpireAfter(dur time.Duration) Expirer { return Duration(dur) }
+
+// Free cast to `time.Duration`. Slightly shorter to type.
+func (self Duration) Duration() time.Duration { return time.Duration(self) }
+
+// Implement `Expirer`. See the description on the type.
+func (self Duration) IsExpired(val Timed) bool {
+	return self.IsExpiredAt(val, time.Now())
+}
+
+// Implement `ExpirerAt` like this: `now > (input + self)`.
+func (self Duration) IsExpiredAt(val Timed, now time.Time) bool {
+	return now.After(val.Time.Add(self.Duration()))
+}
+
+/*
+Implement `encoding.TextMarshaler`, using the format of `time.Duration.String`,
+for example "1m30s".
+*/
+func (self Duration) MarshalText() ([]byte, error) {
+	return []byte(self.Duration().String()), nil
+}
 
-// Free cast to `time.Duration`. Slightly shorter to type.
-func (self Duration) Duration() time.Duration { return time.Duration(self) }
+/*
+Implement `encoding.TextUnmarshaler`, using `time.ParseDuration`. Empty input
+is treated as zero.
+*/
+func (self *Duration) UnmarshalText(src []byte) error {
+	if len(src) == 0 {
+		*self = 0
+		return nil
+	}
 
-// Implement `Expirer`. See the description on the type.
-func (self Duration) IsExpired(val Timed) bool {
-	return time.Now().After(val.Time.Add(self.Duration()))
+	val, err := time.ParseDuration(string(src))
+	if err != nil {
+		return err
+	}
+	*self = Duration(val)
+	return nil
 }
 
 /*
@@ -320,13 +1992,36 @@ type Inst time.Time
 var (
 	_ = Timer(Inst(time.Time{}))
 	_ = Expirer(Inst(time.Time{}))
+	_ = ExpirerAt(Inst(time.Time{}))
 )
 
 // Implement `Timer` by freely casting itself to `time.Time`.
 func (self Inst) Time() time.Time { return time.Time(self) }
 
 // Implement `Expirer` like this: `input > self`.
-func (self Inst) IsExpired(val Timed) bool { return val.Time.After(self.Time()) }
+func (self Inst) IsExpired(val Timed) bool { return self.IsExpiredAt(val, time.Now()) }
+
+/*
+Implement `ExpirerAt` like this: `input > self`. Doesn't depend on the current
+time, and ignores `now`. Defined for consistency with other expirers.
+*/
+func (self Inst) IsExpiredAt(val Timed, _ time.Time) bool {
+	return val.Time.After(self.Time())
+}
+
+/*
+Same as `time.Time.Add`, but returns `Inst`, which allows to build deadlines
+fluently, for example `ded.Inst(base).Add(time.Hour)`. The zero `Inst` is not
+special: adding to it produces a time relative to January 1, year 1.
+*/
+func (self Inst) Add(dur time.Duration) Inst { return Inst(self.Time().Add(dur)) }
+
+/*
+Same as `time.Time.Sub`: returns the duration `self - val`. The result
+saturates at the minimum or maximum `time.Duration`, which is relevant when
+one of the instants is zero and the other is modern.
+*/
+func (self Inst) Sub(val Inst) time.Duration { return self.Time().Sub(val.Time()) }
 
 // Implement `fmt.Stringer` for debug purposes.
 func (self Inst) String() string { return self.Time().String() }
@@ -334,6 +2029,35 @@ func (self Inst) String() string { return self.Time().String() }
 // Implement `fmt.GoStringer` for debug purposes.
 func (self Inst) GoString() string { return fmt.Sprintf(`ded.Inst(%#v)`, self.Time()) }
 
+/*
+Implement `encoding.TextMarshaler`, using RFC3339 with nanoseconds. The zero
+instant is encoded as empty text.
+*/
+func (self Inst) MarshalText() ([]byte, error) {
+	if self.Time().IsZero() {
+		return nil, nil
+	}
+	return []byte(self.Time().Format(time.RFC3339Nano)), nil
+}
+
+/*
+Implement `encoding.TextUnmarshaler`, parsing RFC3339 with optional
+nanoseconds. Empty input is treated as the zero instant.
+*/
+func (self *Inst) UnmarshalText(src []byte) error {
+	if len(src) == 0 {
+		*self = Inst{}
+		return nil
+	}
+
+	val, err := time.Parse(time.RFC3339Nano, string(src))
+	if err != nil {
+		return err
+	}
+	*self = Inst(val)
+	return nil
+}
+
 /*
 Implements `Timer` by calling `time.Now()`. This type is zero-sized, and can be
 embedded in other types for free to add this method, like a mixin, or cast to
@@ -346,6 +2070,38 @@ var _ = Timer(NowTimer{})
 // Implement `Timer` by returning `time.Now()`.
 func (NowTimer) Time() time.Time { return time.Now() }
 
+/*
+Implements `Timer` by returning `time.Now().Add(TTL)`. This inverts the usual
+relationship between `Timer` and `Expirer`: instead of "fetched at", the stored
+timestamp means "valid until", and the expiration policy is decided by the
+timer rather than by the expirer. Pair it with `NowExpirer`, which expires
+values once the current time passes their timestamp. Don't pair it with
+age-based expirers such as `Duration`, which would add another TTL on top.
+*/
+type DeadlineTimer struct{ TTL time.Duration }
+
+var _ = Timer(DeadlineTimer{})
+
+// Implement `Timer` by returning `time.Now().Add(TTL)`.
+func (self DeadlineTimer) Time() time.Time { return time.Now().Add(self.TTL) }
+
+/*
+Implements `Timer` by returning `time.Now().Add(Offset)`. Variant of `NowTimer`
+with a fixed offset, for compensating clock skew, or for simulating values
+fetched in the past or the future, for example in tests. Composes with the
+usual age-based expirers: a negative offset makes values appear older, and
+expire sooner, while a positive offset makes them appear younger. The
+implementation is the same as `DeadlineTimer`, but the timestamp still means
+"fetched at", so this doesn't pair with `NowExpirer`. The zero value is
+equivalent to `NowTimer`.
+*/
+type OffsetTimer struct{ Offset time.Duration }
+
+var _ = Timer(OffsetTimer{})
+
+// Implement `Timer` by returning `time.Now().Add(Offset)`.
+func (self OffsetTimer) Time() time.Time { return time.Now().Add(self.Offset) }
+
 /*
 Implements `Expirer` like this: `time.Now() > input`. This type is zero-sized,
 and can be embedded in other types for free to add this method, like a mixin,
@@ -353,10 +2109,84 @@ or cast to an interface without allocating.
 */
 type NowExpirer struct{}
 
-var _ = Expirer(NowExpirer{})
+var (
+	_ = Expirer(NowExpirer{})
+	_ = ExpirerAt(NowExpirer{})
+)
 
 // Implement `Expirer` like this: `now > input`.
-func (NowExpirer) IsExpired(val Timed) bool { return time.Now().After(val.Time) }
+func (self NowExpirer) IsExpired(val Timed) bool { return self.IsExpiredAt(val, time.Now()) }
+
+// Implement `ExpirerAt` like this: `now > input`.
+func (NowExpirer) IsExpiredAt(val Timed, now time.Time) bool { return now.After(val.Time) }
+
+/*
+Source of the current time. The zero-sized types such as `NowTimer`,
+`NowExpirer` and `Duration` always use the real clock. To inject a different
+clock, for example a fake clock in tests, use `NowTimerClock`,
+`NowExpirerClock` and `DurationClock`.
+*/
+type Clock interface {
+	Now() time.Time
+}
+
+/*
+Implements `Clock` by calling `time.Now()`. This type is zero-sized, and can be
+cast to an interface without allocating.
+*/
+type RealClock struct{}
+
+var _ = Clock(RealClock{})
+
+// Implement `Clock` by returning `time.Now()`.
+func (RealClock) Now() time.Time { return time.Now() }
+
+// Same as `clock.Now()` but nil-safe. Fallback output is `time.Now()`.
+func Now(clock Clock) time.Time {
+	if clock != nil {
+		return clock.Now()
+	}
+	return time.Now()
+}
+
+/*
+Variant of `NowTimer` that uses the provided clock. Nil clock is equivalent to
+`RealClock{}`.
+*/
+func NowTimerClock(clock Clock) Timer { return nowTimerClock{clock} }
+
+type nowTimerClock struct{ clock Clock }
+
+func (self nowTimerClock) Time() time.Time { return Now(self.clock) }
+
+/*
+Variant of `NowExpirer` that uses the provided clock. Nil clock is equivalent to
+`RealClock{}`.
+*/
+func NowExpirerClock(clock Clock) Expirer { return nowExpirerClock{clock} }
+
+type nowExpirerClock struct{ clock Clock }
+
+func (self nowExpirerClock) IsExpired(val Timed) bool {
+	return Now(self.clock).After(val.Time)
+}
+
+/*
+Variant of `Duration` that uses the provided clock. Nil clock is equivalent to
+`RealClock{}`.
+*/
+func DurationClock(clock Clock, dur time.Duration) Expirer {
+	return durationClock{clock, dur}
+}
+
+type durationClock struct {
+	clock Clock
+	dur   time.Duration
+}
+
+func (self durationClock) IsExpired(val Timed) bool {
+	return Now(self.clock).After(val.Time.Add(self.dur))
+}
 
 /*
 Implements `Getter` by calling self. Returns nil if func is nil.
@@ -390,6 +2220,43 @@ func (self TimerFunc) Time() time.Time {
 	return time.Time{}
 }
 
+/*
+Implements `ExpiringGetter` by calling self. Returns nil and the zero time if
+func is nil.
+*/
+type ExpiringGetterFunc func() (interface{}, time.Time)
+
+var _ = ExpiringGetter(ExpiringGetterFunc(nil))
+
+// Implement `ExpiringGetter` by calling itself.
+func (self ExpiringGetterFunc) GetExpiring() (interface{}, time.Time) {
+	if self != nil {
+		return self()
+	}
+	return nil, time.Time{}
+}
+
+/*
+Implements `Expirer` by calling self. Returns true (always expired) if func is
+nil, consistent with a nil `Expirer`. Complements `GetterFunc` and `TimerFunc`.
+Interface conversion `AnyInterface(ExpirerFunc(someFunc))` is zero-alloc.
+*/
+type ExpirerFunc func(Timed) bool
+
+var _ = Expirer(ExpirerFunc(nil))
+
+// Implement `Expirer` by calling itself. Returns true if func is nil.
+func (self ExpirerFunc) IsExpired(val Timed) bool {
+	return self == nil || self(val)
+}
+
+/*
+Alias of `ExpirerFunc`, named for content-aware expiration, where the decision
+depends on the cached value itself, for example on a TTL carried by the value,
+which can be inspected via `Timed.Unwrap`.
+*/
+type ValueExpirer = ExpirerFunc
+
 /*
 Implements `Getter` by returning nil.
 Implements `Timer` by returning `time.Time{}`.
@@ -461,3 +2328,446 @@ type ExpireDay struct{}
 func (ExpireDay) IsExpired(val Timed) bool {
 	return Duration(time.Hour * 24).IsExpired(val)
 }
+
+/*
+Implements `Expirer` by requiring that a given timestamp is no more than a week
+(7 days) old. This type is zero-sized, and can be embedded in other types for
+free to add this method, like a mixin.
+*/
+type ExpireWeek struct{}
+
+// Implement `Expirer` like this: `now > (input + week)`.
+func (ExpireWeek) IsExpired(val Timed) bool {
+	return Duration(time.Hour * 24 * 7).IsExpired(val)
+}
+
+/*
+Implements `Expirer` by requiring that a given timestamp is no more than a month
+(30 days) old. This type is zero-sized, and can be embedded in other types for
+free to add this method, like a mixin.
+*/
+type ExpireMonth struct{}
+
+// Implement `Expirer` like this: `now > (input + month)`.
+func (ExpireMonth) IsExpired(val Timed) bool {
+	return Duration(time.Hour * 24 * 30).IsExpired(val)
+}
+
+/*
+Implements `Expirer` by never expiring a populated value. Useful for values that
+are loaded once and never refreshed, such as configuration. The zero `Timed` is
+the only exception: it's always expired, so that an empty `Mem` is still
+populated on first use. This type is zero-sized, and can be embedded in other
+types for free to add this method, like a mixin.
+*/
+type ExpireNever struct{}
+
+var _ = Expirer(ExpireNever{})
+
+// Implement `Expirer` like this: `input is zero`.
+func (ExpireNever) IsExpired(val Timed) bool { return val.IsZero() }
+
+/*
+Implements `Expirer` by combining other expirers. Reports expiration only if
+every member reports expiration. Nil members are handled via `IsExpired`,
+counting as expired. An empty `ExpirerAnd` is vacuously true: always expired,
+equivalent to a nil expirer.
+*/
+type ExpirerAnd []Expirer
+
+// Implement `Expirer`. See the description on the type.
+func (self ExpirerAnd) IsExpired(val Timed) bool {
+	for _, exp := range self {
+		if !IsExpired(exp, val) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Implements `Expirer` by combining other expirers. Reports expiration if any
+member reports expiration. Nil members are handled via `IsExpired`, counting
+as expired. An empty `ExpirerOr` is never expired, which means that when used
+with `Mem`, the zero value is never replaced.
+*/
+type ExpirerOr []Expirer
+
+// Implement `Expirer`. See the description on the type.
+func (self ExpirerOr) IsExpired(val Timed) bool {
+	for _, exp := range self {
+		if IsExpired(exp, val) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Implements `Expirer` by negating the inner expirer. Nil inner expirer is handled
+via `IsExpired`: since nil is always expired, `ExpirerNot{}` is never expired.
+Composes with `ExpirerAnd` and `ExpirerOr`.
+*/
+type ExpirerNot struct{ Expirer }
+
+// Implement `Expirer`. See the description on the type.
+func (self ExpirerNot) IsExpired(val Timed) bool {
+	return !IsExpired(self.Expirer, val)
+}
+
+/*
+Implements `Expirer` like `Duration`, but adds a pseudo-random offset in the
+range `[0, Jitter)` to `Base`. Useful for spreading out refreshes of many
+values that were populated at roughly the same time.
+
+The offset is derived deterministically from the stored timestamp, so the same
+`Timed` always evaluates consistently. The randomness source is a splitmix64
+hash of the timestamp's Unix nanoseconds combined with `Seed`. It's not
+cryptographically secure. Different seeds produce different offsets for the
+same timestamp; tests may set a fixed seed to get reproducible results.
+
+When `Jitter` is zero or negative, this is equivalent to `Duration(Base)`.
+*/
+type DurationJitter struct {
+	Base   time.Duration
+	Jitter time.Duration
+	Seed   uint64
+}
+
+// Implement `Expirer`. See the description on the type.
+func (self DurationJitter) IsExpired(val Timed) bool {
+	return time.Now().After(val.Time.Add(self.Base + self.Offset(val.Time)))
+}
+
+// Returns the pseudo-random offset in `[0, Jitter)` for the given timestamp.
+func (self DurationJitter) Offset(inst time.Time) time.Duration {
+	if self.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(splitmix64(uint64(inst.UnixNano())^self.Seed) % uint64(self.Jitter))
+}
+
+func splitmix64(val uint64) uint64 {
+	val += 0x9e3779b97f4a7c15
+	val = (val ^ (val >> 30)) * 0xbf58476d1ce4e5b9
+	val = (val ^ (val >> 27)) * 0x94d049bb133111eb
+	return val ^ (val >> 31)
+}
+
+/*
+Implements `Expirer` by comparing the age of the timestamp with a window of
+durations. The value is expired only when its age exceeds `Max`. `Min` is a
+floor: a value younger than `Min` is never expired, even when `Max` is smaller.
+In other words, `Max` is clamped to be at least `Min`, and the effective
+behavior is equivalent to `Duration(max(Min, Max))`. Boundaries follow
+`Duration`: a value whose age is exactly the effective maximum is not yet
+expired.
+*/
+type Window struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// Implement `Expirer`. See the description on the type.
+func (self Window) IsExpired(val Timed) bool {
+	return Duration(self.Limit()).IsExpired(val)
+}
+
+// Returns the effective maximum age: the larger of `Min` and `Max`.
+func (self Window) Limit() time.Duration {
+	if self.Max < self.Min {
+		return self.Min
+	}
+	return self.Max
+}
+
+/*
+Implements `Expirer` by reporting expiration once the age of the timestamp
+reaches the given fraction of `TTL`. For example, with `Ratio: 0.8`, a value is
+refreshed when it reaches 80% of its TTL, avoiding latency spikes at the hard
+expiry. Combined with `(*Mem).DedupStale`, this provides proactive background
+refresh.
+
+`Ratio` must be in the range `(0, 1]`. Out-of-range values, including NaN, are
+treated as 1, which makes this equivalent to `Duration(TTL)`, except for the
+inclusive boundary.
+*/
+type RefreshAhead struct {
+	TTL   time.Duration
+	Ratio float64
+}
+
+// Implement `Expirer` like this: `now >= (input + TTL * Ratio)`.
+func (self RefreshAhead) IsExpired(val Timed) bool {
+	return !time.Now().Before(val.Time.Add(self.Limit()))
+}
+
+// Returns the age at which the value is considered expired.
+func (self RefreshAhead) Limit() time.Duration {
+	ratio := self.Ratio
+	if !(ratio > 0 && ratio <= 1) {
+		ratio = 1
+	}
+	return time.Duration(float64(self.TTL) * ratio)
+}
+
+/*
+Implements `Expirer` with probabilistic early expiration. Values older than
+`TTL` are always expired, like `Duration(TTL)`. Younger values are expired with
+probability `EarlyProb` on each check, so that refreshes of many values trickle
+in over time rather than spiking when their TTLs run out. `EarlyProb` outside
+`(0, 1]`, including NaN, disables early expiration.
+
+`Rand` must return pseudo-random numbers in `[0, 1)`. Nil uses the global
+source of "math/rand", which is concurrency-safe. For deterministic tests,
+provide a seeded source, for example `rand.New(rand.NewSource(seed)).Float64`;
+note that such sources are not concurrency-safe.
+
+`(*Mem).Dedup` checks expiration twice: on the fast path, and again under the
+write lock. The two checks roll independently, and the value is regenerated
+only when both report expiration, so for young values, the effective
+probability of an early refresh per `.Dedup` call is about `EarlyProb` squared.
+*/
+type SampledExpirer struct {
+	TTL       time.Duration
+	EarlyProb float64
+	Rand      func() float64
+}
+
+// Implement `Expirer`. See the description on the type.
+func (self SampledExpirer) IsExpired(val Timed) bool {
+	if Duration(self.TTL).IsExpired(val) {
+		return true
+	}
+
+	prob := self.EarlyProb
+	if !(prob > 0 && prob <= 1) {
+		return false
+	}
+	return self.rand() < prob
+}
+
+func (self SampledExpirer) rand() float64 {
+	if self.Rand != nil {
+		return self.Rand()
+	}
+	return rand.Float64()
+}
+
+/*
+Implements `Expirer` by limiting how many times a value is served. Must be used
+by pointer. Each call to `.IsExpired` counts as one read of the given value,
+and reports expiration once the count exceeds `Max`. The count is reset when a
+newer value is observed. Values are distinguished by their timestamps, so this
+must be paired with a timer that produces increasing timestamps for each
+regeneration, such as `NowTimer`. Values older than the last observed one are
+reported as expired without affecting the count. This happens when concurrent
+readers still hold a previous value, and ensures that they can't reset the
+count of the current value. The zero `Timed` is always expired, and isn't
+counted.
+
+`(*Mem).Dedup` may call `.IsExpired` twice: on the fast path, and again under
+the write lock. The second check happens only when the first one has reported
+expiration. If the value is unchanged, the extra count has no effect, because
+the count only grows and the value remains expired. If another writer has
+regenerated the value in the meantime, the second check observes the new
+timestamp and counts one read of the new value, which is accurate, because
+that call returns the new value. The writer that regenerates a value returns it
+without checking, so each value is served up to `Max + 1` times.
+*/
+type CountExpirer struct {
+	Max   int64
+	lock  sync.Mutex
+	inst  time.Time
+	count int64
+}
+
+// Implement `Expirer`. See the description on the type.
+func (self *CountExpirer) IsExpired(val Timed) bool {
+	if val.IsZero() {
+		return true
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if val.Time.Before(self.inst) {
+		return true
+	}
+	if val.Time.After(self.inst) {
+		self.inst = val.Time
+		self.count = 0
+	}
+
+	self.count++
+	return self.count > self.Max
+}
+
+/*
+Implements `Expirer` as a one-shot "refresh next time" signal, for manual or
+flag-driven invalidation. Must be used by pointer. After `.Invalidate`, the
+currently cached value is reported as expired, until it's replaced by a
+regeneration, which clears the flag. Without invalidation, values never expire,
+except for the zero `Timed`, which is always expired.
+
+The value observed by the first check after `.Invalidate` is remembered as the
+stale one, and values are distinguished by their timestamps, like in
+`CountExpirer`, so this must be paired with a timer that produces distinct
+timestamps for each regeneration, such as `NowTimer`. Because `(*Mem).Dedup`
+checks expiration twice, the flag is not cleared by the check itself: the
+second check, under the write lock, still sees the same stale value and reports
+expiration. Only observing a different value clears the flag. Concurrent
+readers waiting for the writer observe the new value, and reuse it.
+
+Checks without a pending invalidation are a single atomic load.
+*/
+type FlagExpirer struct {
+	flag int32
+	lock sync.Mutex
+	inst time.Time
+	seen bool
+}
+
+var _ = Expirer((*FlagExpirer)(nil))
+
+/*
+Marks the currently cached value as expired. Calling this again before the
+next regeneration has no additional effect. Calling this during a regeneration
+also expires the value it produces, because that value may predate the
+invalidation.
+*/
+func (self *FlagExpirer) Invalidate() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.seen = false
+	atomic.StoreInt32(&self.flag, 1)
+}
+
+// True if there's a pending invalidation.
+func (self *FlagExpirer) IsInvalidated() bool {
+	return atomic.LoadInt32(&self.flag) == 1
+}
+
+// Implement `Expirer`. See the description on the type.
+func (self *FlagExpirer) IsExpired(val Timed) bool {
+	if val.IsZero() {
+		return true
+	}
+	if !self.IsInvalidated() {
+		return false
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if !self.IsInvalidated() {
+		return false
+	}
+
+	if !self.seen {
+		self.seen = true
+		self.inst = val.Time
+		return true
+	}
+
+	if self.inst.Equal(val.Time) {
+		return true
+	}
+
+	atomic.StoreInt32(&self.flag, 0)
+	return false
+}
+
+/*
+Implements `Expirer` by comparing the current time with an absolute deadline,
+regardless of when the value was fetched: every value expires once
+`time.Now() > self`. Useful for caching something until a specific wall-clock
+time, such as midnight. Compare `Inst`, which compares the deadline with the
+input timestamp rather than the current time.
+
+The zero `Timed` is always expired, so that an empty `Mem` is populated even
+before the deadline.
+*/
+type ExpireAt time.Time
+
+var _ = Expirer(ExpireAt{})
+
+// Implement `Expirer` like this: `input is zero || now > self`.
+func (self ExpireAt) IsExpired(val Timed) bool {
+	return val.IsZero() || time.Now().After(time.Time(self))
+}
+
+// Implement `fmt.GoStringer` for debug purposes.
+func (self ExpireAt) GoString() string {
+	return fmt.Sprintf(`ded.ExpireAt(%#v)`, time.Time(self))
+}
+
+/*
+Implements `Expirer` for values that carry an opaque version token, such as an
+HTTP ETag. The value is expired if `Inner` says so, or if the version embedded
+in the cached value differs from the currently wanted version. The embedded
+version is extracted by calling `Version` with the inner value, which may be an
+error; nil `Version` uses the inner value itself. The wanted version comes
+from `Want`, which is called on every check; nil `Want` disables the version
+check. Versions are compared via `reflect.DeepEqual`.
+
+Unlike most wrappers, nil `Inner` means no time-based expiration, rather than
+always expired, so that `VersionExpirer` can be used on its own. The zero
+`Timed` is always expired, so that an empty `Mem` is populated regardless of
+versions.
+*/
+type VersionExpirer struct {
+	Want    func() interface{}
+	Version func(interface{}) interface{}
+	Inner   Expirer
+}
+
+var _ = Expirer(VersionExpirer{})
+
+// Implement `Expirer`. See the description on the type.
+func (self VersionExpirer) IsExpired(val Timed) bool {
+	if val.IsZero() {
+		return true
+	}
+	if self.Inner != nil && self.Inner.IsExpired(val) {
+		return true
+	}
+	if self.Want == nil {
+		return false
+	}
+
+	have := val.Either[0]
+	if self.Version != nil {
+		have = self.Version(have)
+	}
+	return !reflect.DeepEqual(self.Want(), have)
+}
+
+/*
+Expiration policy with three zones, used by `Mem.DedupTiered`. Values younger
+than `Fresh` are fresh, and served directly. Values older than `Fresh` but
+younger than `Stale` are stale: served, but refreshed in the background.
+Values older than `Stale` are dead, and must be refreshed before serving. The
+zero `Timed` is always dead. If `Stale` is less than `Fresh`, there's no stale
+zone. Nil `Clock` means `RealClock`.
+
+Also implements `Expirer`, where "expired" means dead. This allows using
+`Tiered` with `Mem.Dedup`, which ignores the stale zone.
+*/
+type Tiered struct {
+	Fresh time.Duration
+	Stale time.Duration
+	Clock Clock
+}
+
+var _ = Expirer(Tiered{})
+
+// True if the value is no longer fresh, which includes dead values.
+func (self Tiered) IsStale(val Timed) bool { return self.isOlder(val, self.Fresh) }
+
+// Implement `Expirer`, reporting whether the value is dead.
+func (self Tiered) IsExpired(val Timed) bool { return self.isOlder(val, self.Stale) }
+
+func (self Tiered) isOlder(val Timed, dur time.Duration) bool {
+	return val.IsZero() || Now(self.Clock).After(val.Time.Add(dur))
+}
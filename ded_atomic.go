@@ -0,0 +1,74 @@
+package ded
+
+import "sync/atomic"
+
+/*
+Variant of `Mem` with lock-free reads, backed by `atomic.Pointer`. The zero
+value is ready to use, but must not be copied (use it by pointer). All methods
+of `*AtomicMem` are concurrency-safe.
+
+Trade-off versus `Mem`: both have lock-free reads, but there's no write lock to
+coalesce writers: when the value expires, every concurrent caller that observes
+the expired value calls the getter, and the first to finish installs its result
+via compare-and-swap. In exchange, writers never wait for each other, and the
+type is smaller, with no write lock, listener, or generation counter. Use this
+only when writes are rare, and redundant getter calls are acceptable. When
+getters are expensive, and deduplicating them is the point, use `Mem`.
+
+Requires Go 1.19 for `atomic.Pointer`.
+*/
+type AtomicMem struct{ ptr atomic.Pointer[Timed] }
+
+var _ = Deduper((*AtomicMem)(nil))
+
+// Shorthand for `.GetTimed().Get()`. Never blocks.
+func (self *AtomicMem) Get() interface{} { return self.GetTimed().Get() }
+
+/*
+Returns the currently-cached state, via a single atomic load. Never blocks.
+Initially this returns the zero value `Timed{}`.
+*/
+func (self *AtomicMem) GetTimed() Timed { return derefTimed(self.ptr.Load()) }
+
+// Replaces the cached state with the provided state.
+func (self *AtomicMem) SetTimed(val Timed) { self.ptr.Store(&val) }
+
+// Zeroes the state, resetting it to `Timed{}`.
+func (self *AtomicMem) Zero() { self.ptr.Store(nil) }
+
+/*
+Lock-free variant of `Mem.Dedup`. If the current value is fresh, returns it.
+Otherwise, calls the getter and the timer, and attempts to install the result
+via compare-and-swap. If another writer has installed a value in the meantime,
+and that value is fresh, returns that value, discarding this call's result.
+Otherwise retries the swap with this call's result, without calling the getter
+again. Concurrent callers may call the getter redundantly; see the description
+on the type.
+*/
+func (self *AtomicMem) Dedup(get Getter, time Timer, exp Expirer) Timed {
+	prev := self.ptr.Load()
+	val := derefTimed(prev)
+	if !IsExpired(exp, val) {
+		return val
+	}
+
+	next := val
+	next.SetGetter(get)
+	next.SetTimer(time)
+
+	for !self.ptr.CompareAndSwap(prev, &next) {
+		prev = self.ptr.Load()
+		val = derefTimed(prev)
+		if !IsExpired(exp, val) {
+			return val
+		}
+	}
+	return next
+}
+
+func derefTimed(val *Timed) Timed {
+	if val != nil {
+		return *val
+	}
+	return Timed{}
+}
@@ -0,0 +1,141 @@
+package ded
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_AtomicMem_GetTimed(t *testing.T) {
+	var mem AtomicMem
+	eq(t, Timed{}, mem.GetTimed())
+	eq(t, nil, mem.Get())
+
+	for _, val := range testVals {
+		for _, inst := range testTimes {
+			mem.SetTimed(MakeTimed(val, inst))
+			eq(t, MakeTimed(val, inst), mem.GetTimed())
+		}
+	}
+
+	mem.Zero()
+	eq(t, Timed{}, mem.GetTimed())
+}
+
+func Test_AtomicMem_Dedup(t *testing.T) {
+	var mem AtomicMem
+	inst := Inst(testTimes[1])
+
+	eq(t, MakeTimed(10, inst.Time()), mem.Dedup(Either{10}, inst, nil))
+	eq(t, MakeTimed(10, inst.Time()), mem.Dedup(failGetter(t), failTimer(t), BoolExpirer(false)))
+	eq(t, MakeTimed(20, inst.Time()), mem.Dedup(Either{20}, inst, BoolExpirer(true)))
+	eq(t, MakeTimed(20, inst.Time()), mem.GetTimed())
+
+	err := testErr()
+	eq(t, MakeTimed(err, time.Time{}), mem.Dedup(GetterFunc(func() interface{} { panic(err) }), nil, nil))
+}
+
+func Test_AtomicMem_reads_dont_block(t *testing.T) {
+	mem := new(AtomicMem)
+	mem.SetTimed(MakeTimed(`old value`, time.Time{}))
+	getter := newSlowGetter(`new value`)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		mem.Dedup(getter, Void{}, BoolExpirer(true))
+	}()
+
+	// The writer is inside the getter, and hasn't published the new value yet.
+	<-getter.Entered()
+
+	eq(t, MakeTimed(`old value`, time.Time{}), mem.GetTimed())
+	eq(t, false, isDone(done))
+
+	getter.Done()
+	<-done
+	eq(t, MakeTimed(`new value`, time.Time{}), mem.GetTimed())
+}
+
+func Test_AtomicMem_Dedup_concurrent(t *testing.T) {
+	var mem AtomicMem
+	var calls int64
+	const count = 64
+
+	getter := GetterFunc(func() interface{} {
+		return atomic.AddInt64(&calls, 1)
+	})
+
+	out := make(chan Timed, count)
+	var wg sync.WaitGroup
+	for range counter(count) {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			out <- mem.Dedup(getter, Void{}, IsZeroExpirer{})
+		}()
+	}
+	wg.Wait()
+	close(out)
+
+	// Writers may race, but every caller observes the single installed value.
+	stored := mem.GetTimed()
+	for val := range out {
+		eq(t, stored, val)
+	}
+
+	eq(t, true, calls >= 1 && calls <= count)
+}
+
+func Benchmark_Mem_GetTimed_parallel(b *testing.B) {
+	mem := NewMem(MakeTimed(10, time.Time{}))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mem.GetTimed()
+		}
+	})
+}
+
+func Benchmark_AtomicMem_GetTimed_parallel(b *testing.B) {
+	var mem AtomicMem
+	mem.SetTimed(MakeTimed(10, time.Time{}))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mem.GetTimed()
+		}
+	})
+}
+
+func Benchmark_Mem_Dedup_fresh_parallel(b *testing.B) {
+	mem := NewMem(MakeTimed(10, time.Time{}))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mem.Dedup(GetterFunc(staticGetter), Void{}, BoolExpirer(false))
+		}
+	})
+}
+
+// Fresh reads while a writer holds the lock. They don't touch the lock, and
+// should perform like `Benchmark_Mem_Dedup_fresh_parallel`.
+func Benchmark_Mem_Dedup_fresh_parallel_during_write(b *testing.B) {
+	mem := NewMem(MakeTimed(10, time.Time{}))
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mem.Dedup(GetterFunc(staticGetter), Void{}, BoolExpirer(false))
+		}
+	})
+}
+
+func Benchmark_AtomicMem_Dedup_fresh_parallel(b *testing.B) {
+	var mem AtomicMem
+	mem.SetTimed(MakeTimed(10, time.Time{}))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mem.Dedup(GetterFunc(staticGetter), Void{}, BoolExpirer(false))
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package ded
+
+/*
+Specialization of `Mem` for caching byte payloads, such as rendered templates
+or compressed assets. Stores either `[]byte` or an error, and returns them
+typed, avoiding type assertions at call sites. The zero value is ready to use,
+but must not be copied (use it by pointer). All methods of `*Bytes` are
+concurrency-safe.
+*/
+type Bytes struct{ Mem }
+
+/*
+Same as `Mem.Dedup`, but uses a standard Go function returning `([]byte,
+error)` as the getter, and returns the result typed. When the cached value is
+fresh, returns the same slice as the previous call, without copying, so callers
+must not modify it. A non-nil error is cached just like any other error, and
+returned with a nil slice. Panics in the getter are caught and returned as
+errors. Nil getter produces a nil slice and a nil error.
+*/
+func (self *Bytes) DedupBytes(get func() ([]byte, error), time Timer, exp Expirer) ([]byte, error) {
+	var getter Getter
+	if get != nil {
+		getter = bytesGetter(get)
+	}
+
+	val, err := self.Dedup(getter, time, exp).Unwrap()
+	if err != nil {
+		return nil, err
+	}
+
+	out, _ := val.([]byte)
+	return out, nil
+}
+
+type bytesGetter func() ([]byte, error)
+
+func (self bytesGetter) Get() interface{} {
+	val, err := self.get()
+	if err != nil {
+		return err
+	}
+	return val
+}
+
+// Converts non-error panics into errors, so they're returned as such.
+func (self bytesGetter) get() (_ []byte, err error) {
+	defer recErr(&err)
+	return self()
+}
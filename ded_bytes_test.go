@@ -0,0 +1,42 @@
+package ded
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Bytes_DedupBytes(t *testing.T) {
+	var tar Bytes
+	inst := Inst(testTimes[1])
+
+	val, err := tar.DedupBytes(func() ([]byte, error) { return []byte(`one`), nil }, inst, nil)
+	eq(t, nil, err)
+	eq(t, []byte(`one`), val)
+
+	cached, err := tar.DedupBytes(func() ([]byte, error) {
+		t.Fatal(`unexpected getter call`)
+		return nil, nil
+	}, failTimer(t), BoolExpirer(false))
+	eq(t, nil, err)
+
+	// Hits reuse the same slice.
+	eq(t, &val[0], &cached[0])
+	eq(t, MakeTimed([]byte(`one`), inst.Time()), tar.GetTimed())
+}
+
+func Test_Bytes_DedupBytes_err(t *testing.T) {
+	var tar Bytes
+
+	val, err := tar.DedupBytes(func() ([]byte, error) { return []byte(`ignored`), testErr() }, nil, nil)
+	eq(t, []byte(nil), val)
+	eq(t, testErr(), err)
+	eq(t, MakeTimed(testErr(), time.Time{}), tar.GetTimed())
+
+	val, err = tar.DedupBytes(func() ([]byte, error) { panic(`str`) }, nil, nil)
+	eq(t, []byte(nil), val)
+	eqPanicErr(t, `str`, err)
+
+	val, err = tar.DedupBytes(nil, nil, nil)
+	eq(t, []byte(nil), val)
+	eq(t, nil, err)
+}
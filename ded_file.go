@@ -0,0 +1,74 @@
+package ded
+
+import (
+	"os"
+	"time"
+)
+
+/*
+Returns a `Getter` that reads the file at the given path, returning its
+contents as `[]byte`. Errors, including a missing file, are returned as values,
+which `Either` stores as errors. To reload the file only when it changes, use
+`FileModGetter` with `FileModExpirer`.
+*/
+func FileGetter(path string) Getter { return fileGetter(path) }
+
+/*
+Returns an `ExpiringGetter` that reads the file at the given path, like
+`FileGetter`, and also returns its modification time, or `time.Time{}` if the
+file can't be stat'ed. The modification time is taken before reading, so if the
+file is modified during or after the read, the contents are stamped with the
+older time, and the next check by `FileModExpirer` reports the change. Usage:
+
+	mem.DedupExpiring(ded.FileModGetter(path), ded.FileModExpirer{path})
+
+Unlike most uses of `(*Mem).DedupExpiring`, the resulting timestamp is the
+modification time rather than a deadline, which is what `FileModExpirer`
+expects. Using the file's own modification time, rather than `NowTimer`, also
+avoids missing changes due to coarse filesystem timestamps or clock differences
+between the filesystem and the process.
+*/
+func FileModGetter(path string) ExpiringGetter { return fileGetter(path) }
+
+type fileGetter string
+
+func (self fileGetter) Get() interface{} {
+	val, err := os.ReadFile(string(self))
+	if err != nil {
+		return err
+	}
+	return val
+}
+
+func (self fileGetter) GetExpiring() (interface{}, time.Time) {
+	info, err := os.Stat(string(self))
+	if err != nil {
+		return err, time.Time{}
+	}
+	return self.Get(), info.ModTime()
+}
+
+/*
+Implements `Expirer` by comparing the modification time of the file at `Path`
+with the cached timestamp. The value is expired when the file was modified
+after the timestamp, or when the file can't be stat'ed, for example because
+it's missing, so that the getter runs and reports the error. The zero `Timed`
+is always expired. Expects timestamps produced by `FileModGetter`; see its
+description.
+*/
+type FileModExpirer struct{ Path string }
+
+var _ = Expirer(FileModExpirer{})
+
+// Implement `Expirer`. See the description on the type.
+func (self FileModExpirer) IsExpired(val Timed) bool {
+	if val.IsZero() {
+		return true
+	}
+
+	info, err := os.Stat(self.Path)
+	if err != nil {
+		return true
+	}
+	return info.ModTime().After(val.Time)
+}
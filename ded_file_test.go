@@ -0,0 +1,114 @@
+package ded
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_FileGetter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `file`)
+
+	err, _ := FileGetter(path).Get().(error)
+	eq(t, true, errors.Is(err, fs.ErrNotExist))
+
+	writeTestFile(t, path, `one`, time.Now())
+	eq(t, []byte(`one`), FileGetter(path).Get())
+}
+
+func Test_FileModGetter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `file`)
+
+	val, inst := FileModGetter(path).GetExpiring()
+	err, _ := val.(error)
+	eq(t, true, errors.Is(err, fs.ErrNotExist))
+	eq(t, time.Time{}, inst)
+
+	mod := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	writeTestFile(t, path, `one`, mod)
+
+	val, inst = FileModGetter(path).GetExpiring()
+	eq(t, []byte(`one`), val)
+	eq(t, true, inst.Equal(mod))
+}
+
+func Test_FileModExpirer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `file`)
+	exp := FileModExpirer{path}
+	inst := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	eq(t, true, exp.IsExpired(Timed{}))
+	eq(t, true, exp.IsExpired(MakeTimed(nil, inst)))
+
+	writeTestFile(t, path, `one`, inst)
+	eq(t, true, exp.IsExpired(Timed{}))
+	eq(t, false, exp.IsExpired(MakeTimed(nil, inst)))
+	eq(t, true, exp.IsExpired(MakeTimed(nil, inst.Add(-time.Second))))
+}
+
+func Test_FileModGetter_with_FileModExpirer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `file`)
+	get := FileModGetter(path)
+	exp := FileModExpirer{path}
+	var mem Mem
+
+	err := mem.DedupExpiring(get, exp).Err()
+	eq(t, true, errors.Is(err, fs.ErrNotExist))
+
+	inst := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	writeTestFile(t, path, `one`, inst)
+	eq(t, []byte(`one`), mem.DedupExpiring(get, exp).Get())
+
+	// Unchanged file is not reloaded.
+	eq(t, []byte(`one`), mem.DedupExpiring(failExpiringGetter(t), exp).Get())
+
+	writeTestFile(t, path, `two`, inst.Add(time.Second))
+	eq(t, []byte(`two`), mem.DedupExpiring(get, exp).Get())
+	eq(t, []byte(`two`), mem.DedupExpiring(failExpiringGetter(t), exp).Get())
+
+	os.Remove(path)
+	err = mem.DedupExpiring(get, exp).Err()
+	eq(t, true, errors.Is(err, fs.ErrNotExist))
+}
+
+/*
+Simulates a write that lands right after the read. The contents must be stamped
+with the modification time of the version that was read, so that the write is
+detected on the next call.
+*/
+func Test_FileModGetter_write_after_read(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `file`)
+	exp := FileModExpirer{path}
+	inst := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	var mem Mem
+
+	writeTestFile(t, path, `one`, inst)
+
+	get := ExpiringGetterFunc(func() (interface{}, time.Time) {
+		val, mod := FileModGetter(path).GetExpiring()
+		writeTestFile(t, path, `two`, inst.Add(time.Second))
+		return val, mod
+	})
+
+	eq(t, []byte(`one`), mem.DedupExpiring(get, exp).Get())
+	eq(t, []byte(`two`), mem.DedupExpiring(FileModGetter(path), exp).Get())
+	eq(t, []byte(`two`), mem.DedupExpiring(failExpiringGetter(t), exp).Get())
+}
+
+// Explicit modtimes make the tests independent of filesystem granularity.
+func writeTestFile(t testing.TB, path, body string, inst time.Time) {
+	t.Helper()
+
+	err := os.WriteFile(path, []byte(body), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chtimes(path, inst, inst)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,161 @@
+package ded
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+Returned by `Mem.DedupWithTimeout` when the operation doesn't complete in time.
+`TimeoutError` also matches it via `errors.Is`.
+*/
+var ErrTimeout = errors.New(`[ded] timed out`)
+
+/*
+Returned by getters that didn't complete in time, such as the getter made by
+`TimeoutGetter`. Stored in `Either` like any other error.
+*/
+type TimeoutError struct{ Duration time.Duration }
+
+// Implement `error`.
+func (self TimeoutError) Error() string {
+	return fmt.Sprintf(`[ded] getter timed out after %v`, self.Duration)
+}
+
+// Implement the informal interface used by `net.Error`.
+func (TimeoutError) Timeout() bool { return true }
+
+// Implement the interface used by `errors.Is`, matching `ErrTimeout`.
+func (TimeoutError) Is(err error) bool { return err == ErrTimeout }
+
+/*
+Wraps the given getter, limiting its runtime. The inner getter runs on a
+separate goroutine. If it doesn't complete within the given duration, the
+outer getter returns `TimeoutError`, which `Either` stores as an error. Panics
+in the inner getter are caught and returned as values, just like in
+`Either.SetGetter`.
+
+If the inner getter never returns, its goroutine leaks. If it returns after the
+timeout, its result is discarded, and the goroutine exits. Zero or negative
+duration disables the timeout. Nil inner getter returns nil.
+*/
+func TimeoutGetter(dur time.Duration, inner Getter) Getter {
+	return timeoutGetter{dur, inner}
+}
+
+type timeoutGetter struct {
+	dur   time.Duration
+	inner Getter
+}
+
+func (self timeoutGetter) Get() interface{} {
+	if self.inner == nil {
+		return nil
+	}
+
+	if self.dur <= 0 {
+		return self.inner.Get()
+	}
+
+	// Buffered, so that a late getter doesn't block forever.
+	out := make(chan Either, 1)
+
+	go func() {
+		var val Either
+		defer func() { out <- val }()
+		val.SetGetter(self.inner)
+	}()
+
+	timer := time.NewTimer(self.dur)
+	defer timer.Stop()
+
+	select {
+	case val := <-out:
+		return val[0]
+	case <-timer.C:
+		return TimeoutError{self.dur}
+	}
+}
+
+/*
+Adapts a standard Go function returning `(value, error)` into a `Getter`. If the
+function returns a non-nil error, the getter returns that error, which `Either`
+stores as an error, ignoring the value. Otherwise returns the value. Nil
+function returns nil.
+*/
+func ErrGetter(fun func() (interface{}, error)) Getter { return errGetter(fun) }
+
+type errGetter func() (interface{}, error)
+
+func (self errGetter) Get() interface{} {
+	if self == nil {
+		return nil
+	}
+
+	val, err := self()
+	if err != nil {
+		return err
+	}
+	return val
+}
+
+/*
+Implements `Getter` by calling the inner getter up to `Attempts` times, sleeping
+`Backoff` between attempts. A panic or an `error` result counts as a failure.
+Returns the first successful value. If all attempts fail, returns the last
+error, which `Either` stores as an error. Zero or negative `Attempts` is
+treated as 1. Nil inner getter returns nil.
+*/
+type RetryGetter struct {
+	Getter   Getter
+	Attempts int
+	Backoff  time.Duration
+}
+
+var _ = Getter(RetryGetter{})
+
+// Implement `Getter`. See the description on the type.
+func (self RetryGetter) Get() interface{} {
+	var val Either
+
+	for i := 0; i < self.Attempts || i == 0; i++ {
+		if i > 0 && self.Backoff > 0 {
+			time.Sleep(self.Backoff)
+		}
+
+		val.SetGetter(self.Getter)
+		_, err := val.Unwrap()
+		if err == nil {
+			break
+		}
+	}
+
+	return val[0]
+}
+
+/*
+Returns a `Getter` that calls the given getters in order, returning the first
+successful value. A panic or an `error` result counts as a failure, and moves
+on to the next getter. If all getters fail, returns the last error, which
+`Either` stores as an error. Nil getters are considered to return nil, which
+counts as success, consistent with `Either.SetGetter`. With no getters,
+returns nil.
+*/
+func FallbackGetter(getters ...Getter) Getter { return fallbackGetter(getters) }
+
+type fallbackGetter []Getter
+
+func (self fallbackGetter) Get() interface{} {
+	var val Either
+
+	for _, get := range self {
+		val.SetGetter(get)
+		_, err := val.Unwrap()
+		if err == nil {
+			break
+		}
+	}
+
+	return val[0]
+}
@@ -0,0 +1,106 @@
+package ded
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_TimeoutGetter_in_time(t *testing.T) {
+	eq(t, nil, TimeoutGetter(time.Second, nil).Get())
+	eq(t, `val`, TimeoutGetter(time.Second, Either{`val`}).Get())
+	eq(t, `val`, TimeoutGetter(0, Either{`val`}).Get())
+
+	err := testErr()
+	eq(t, err, TimeoutGetter(time.Second, GetterFunc(func() interface{} { panic(err) })).Get())
+}
+
+func Test_TimeoutGetter_timeout(t *testing.T) {
+	getter := newSlowGetter(`val`)
+	defer getter.Done()
+
+	eq(t, TimeoutError{time.Millisecond}, TimeoutGetter(time.Millisecond, getter).Get())
+	eq(t, true, errors.Is(TimeoutError{time.Millisecond}, ErrTimeout))
+
+	var tar Either
+	tar.SetGetter(TimeoutGetter(time.Millisecond, getter))
+	panics(t, TimeoutError{time.Millisecond}, func() { tar.Get() })
+}
+
+func Test_ErrGetter(t *testing.T) {
+	eq(t, nil, ErrGetter(nil).Get())
+	eq(t, `val`, ErrGetter(func() (interface{}, error) { return `val`, nil }).Get())
+	eq(t, testErr(), ErrGetter(func() (interface{}, error) { return `val`, testErr() }).Get())
+
+	var tar Either
+	tar.SetGetter(ErrGetter(func() (interface{}, error) { return `val`, nil }))
+	eq(t, `val`, tar.Get())
+
+	tar.SetGetter(ErrGetter(func() (interface{}, error) { return nil, testErr() }))
+	eq(t, Either{testErr()}, tar)
+	panics(t, testErr(), func() { tar.Get() })
+}
+
+func Test_RetryGetter(t *testing.T) {
+	eq(t, nil, RetryGetter{}.Get())
+	eq(t, `val`, RetryGetter{Getter: Either{`val`}}.Get())
+}
+
+func Test_RetryGetter_fail_then_succeed(t *testing.T) {
+	var calls int
+	getter := GetterFunc(func() interface{} {
+		calls++
+		switch calls {
+		case 1:
+			return testErr()
+		case 2:
+			panic(testErr())
+		default:
+			return `val`
+		}
+	})
+
+	eq(t, `val`, RetryGetter{getter, 5, time.Microsecond}.Get())
+	eq(t, 3, calls)
+}
+
+func Test_RetryGetter_always_fail(t *testing.T) {
+	var calls int
+	getter := GetterFunc(func() interface{} {
+		calls++
+		panic(testErr())
+	})
+
+	eq(t, testErr(), RetryGetter{getter, 3, time.Microsecond}.Get())
+	eq(t, 3, calls)
+
+	calls = 0
+	eq(t, testErr(), RetryGetter{Getter: getter}.Get())
+	eq(t, 1, calls)
+}
+
+func Test_FallbackGetter(t *testing.T) {
+	eq(t, nil, FallbackGetter().Get())
+	eq(t, nil, FallbackGetter(nil).Get())
+	eq(t, `one`, FallbackGetter(Either{`one`}, failGetter(t)).Get())
+}
+
+func Test_FallbackGetter_first_fails(t *testing.T) {
+	err := testErr()
+	panicky := GetterFunc(func() interface{} { panic(err) })
+
+	eq(t, `two`, FallbackGetter(Either{err}, Either{`two`}, failGetter(t)).Get())
+	eq(t, `two`, FallbackGetter(panicky, Either{`two`}).Get())
+	eq(t, `three`, FallbackGetter(panicky, Either{err}, Either{`three`}).Get())
+}
+
+func Test_FallbackGetter_all_fail(t *testing.T) {
+	last := fmt.Errorf(`last error`)
+	getter := FallbackGetter(Either{testErr()}, GetterFunc(func() interface{} { panic(last) }))
+	eq(t, last, getter.Get())
+
+	var tar Either
+	tar.SetGetter(getter)
+	panics(t, last, func() { tar.Get() })
+}
@@ -0,0 +1,57 @@
+package ded
+
+import "sync"
+
+/*
+Coalesces concurrent calls with the same key into a single getter invocation,
+independently of any `Mem`. Similar to `golang.org/x/sync/singleflight`, but
+integrated with the panic-catching semantics of `Either`. Unlike `Mem`, doesn't
+cache anything: once a call completes, the next call with the same key invokes
+its getter again. The zero value is ready to use, but must not be copied (use
+it by pointer). All methods of `*Group` are concurrency-safe.
+*/
+type Group struct {
+	lock  sync.Mutex
+	calls map[string]*groupCall
+}
+
+/*
+Calls the getter, unless another call with the same key is already in progress,
+in which case waits for that call and returns its result. Panics in the getter
+are caught and stored, just like in `Either.SetGetter`. Because there's no
+timer, the resulting timestamp is always `time.Time{}`.
+*/
+func (self *Group) Do(key string, get Getter) Timed {
+	self.lock.Lock()
+
+	call := self.calls[key]
+	if call != nil {
+		call.dups++
+		self.lock.Unlock()
+		call.Wait()
+		return call.val
+	}
+
+	call = new(groupCall)
+	call.Add(1)
+	if self.calls == nil {
+		self.calls = map[string]*groupCall{}
+	}
+	self.calls[key] = call
+	self.lock.Unlock()
+
+	call.val.SetGetter(get)
+
+	self.lock.Lock()
+	delete(self.calls, key)
+	self.lock.Unlock()
+
+	call.Done()
+	return call.val
+}
+
+type groupCall struct {
+	sync.WaitGroup
+	val  Timed
+	dups int // Callers waiting for this call. Protected by the group's lock.
+}
@@ -0,0 +1,66 @@
+package ded
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Group_Do(t *testing.T) {
+	var group Group
+	eq(t, Timed{}, group.Do(`one`, nil))
+	eq(t, MakeTimed(10, time.Time{}), group.Do(`one`, Either{10}))
+	eq(t, MakeTimed(20, time.Time{}), group.Do(`one`, Either{20}))
+
+	err := testErr()
+	eq(t, MakeTimed(err, time.Time{}), group.Do(`one`, GetterFunc(func() interface{} { panic(err) })))
+	eq(t, 0, len(group.calls))
+}
+
+func Test_Group_Do_concurrent(t *testing.T) {
+	var group Group
+	var calls int64
+	slow := newSlowGetter(`val`)
+
+	getter := GetterFunc(func() interface{} {
+		atomic.AddInt64(&calls, 1)
+		return slow.Get()
+	})
+
+	const count = 8
+	var wg sync.WaitGroup
+	for range counter(count) {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			eq(t, MakeTimed(`val`, time.Time{}), group.Do(`key`, getter))
+		}()
+	}
+
+	// Release the getter only after every other caller has joined the call.
+	<-slow.Entered()
+	for groupDups(&group, `key`) < count-1 {
+		runtime.Gosched()
+	}
+
+	// Distinct keys don't wait for each other.
+	eq(t, MakeTimed(`other`, time.Time{}), group.Do(`other`, Either{`other`}))
+
+	slow.Done()
+	wg.Wait()
+
+	eq(t, int64(1), calls)
+}
+
+func groupDups(group *Group, key string) int {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+
+	call := group.calls[key]
+	if call == nil {
+		return 0
+	}
+	return call.dups
+}
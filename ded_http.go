@@ -0,0 +1,61 @@
+package ded
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+/*
+Returns a `Getter` that performs an HTTP GET request to the given URL, returning
+the response body as `[]byte`. Transport errors and non-2xx responses are
+returned as errors, which `Either` stores as errors; non-2xx responses are
+reported as `HTTPError`. Nil client uses `http.DefaultClient`. There's no
+built-in timeout; use a client with `http.Client.Timeout`, or wrap the getter
+in `TimeoutGetter`.
+*/
+func HTTPGetter(client *http.Client, url string) Getter {
+	return httpGetter{client, url}
+}
+
+type httpGetter struct {
+	client *http.Client
+	url    string
+}
+
+func (self httpGetter) Get() interface{} {
+	client := self.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Get(self.url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return HTTPError{URL: self.url, Status: res.StatusCode}
+	}
+
+	val, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return val
+}
+
+// Returned by `HTTPGetter` for responses with a non-2xx status code.
+type HTTPError struct {
+	URL    string
+	Status int
+}
+
+// Implement `error`.
+func (self HTTPError) Error() string {
+	return fmt.Sprintf(
+		`[ded] unexpected HTTP status %v %v for GET %v`,
+		self.Status, http.StatusText(self.Status), self.URL,
+	)
+}
@@ -0,0 +1,41 @@
+package ded
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func Test_HTTPGetter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rew http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == `/fail` {
+			rew.WriteHeader(http.StatusInternalServerError)
+		}
+		_, _ = rew.Write([]byte(`body of ` + req.URL.Path))
+	}))
+	defer srv.Close()
+
+	eq(t, []byte(`body of /ok`), HTTPGetter(nil, srv.URL+`/ok`).Get())
+	eq(t, []byte(`body of /ok`), HTTPGetter(srv.Client(), srv.URL+`/ok`).Get())
+
+	err := HTTPError{URL: srv.URL + `/fail`, Status: http.StatusInternalServerError}
+	eq(t, err, HTTPGetter(nil, srv.URL+`/fail`).Get())
+	eq(t, `[ded] unexpected HTTP status 500 Internal Server Error for GET `+srv.URL+`/fail`, err.Error())
+
+	var mem Mem
+	eq(t, MakeTimed(err, testTimes[1]), mem.Dedup(HTTPGetter(nil, srv.URL+`/fail`), Inst(testTimes[1]), nil))
+}
+
+func Test_HTTPGetter_connection_refused(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	var mem Mem
+	_, err := mem.Dedup(HTTPGetter(nil, srv.URL), nil, nil).Unwrap()
+
+	var urlErr *url.Error
+	eq(t, true, errors.As(err, &urlErr))
+	eq(t, `Get`, urlErr.Op)
+}
@@ -0,0 +1,237 @@
+package ded
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+)
+
+/*
+Creates a `Map` limited to the given number of entries. When adding a new key
+would exceed the limit, the least-recently-used key is evicted. Every
+`.Dedup` counts as an access. To keep cache hits lock-free, a hit that finds
+the map's lock held by another goroutine skips updating the recency rather than
+waiting, so under heavy contention the eviction order is approximate. Keys with
+an expired value currently in use by `.Dedup`, including a writer in the middle
+of regenerating the value, are never evicted; if all keys are in use, the map
+temporarily exceeds the limit. Zero or negative limit means no limit,
+equivalent to the zero value of `Map`.
+*/
+func NewMapLRU(maxEntries int) *Map { return &Map{max: maxEntries} }
+
+/*
+Keyed collection of `Mem`, for deduplicating per-key. The zero value is ready to
+use, but must not be copied (use it by pointer). Each key has its own `Mem`,
+created lazily on first use. All methods of `*Map` are concurrency-safe. The
+zero value is unbounded; see `NewMapLRU` for a size-bounded variant.
+
+Looking up existing entries is lock-free, using a `sync.Map`, so cache hits
+never wait for each other, just like reads of `Mem`. The map's own lock is held
+only while creating or deleting entries, and, for `NewMapLRU`, while tracking
+usage; never while calling getters. Each key is synchronized by its own `Mem`,
+so distinct keys never block each other.
+*/
+type Map struct {
+	lock sync.Mutex
+	max  int
+	mems map[string]*mapEntry
+	lru  list.List
+	ents sync.Map // Mirror of `.mems` for lock-free lookups; written under lock.
+}
+
+/*
+Same as `(*Mem).Dedup` for the `Mem` associated with the given key, creating
+it if necessary.
+*/
+func (self *Map) Dedup(key string, get Getter, time Timer, exp Expirer) Timed {
+	ent := self.load(key)
+	if ent != nil {
+		val := ent.GetTimed()
+		if !IsExpired(exp, val) {
+			self.touch(ent)
+			return val
+		}
+	}
+
+	// Unbounded maps don't track usage, and can reuse the existing entry.
+	if ent == nil || self.max > 0 {
+		ent = self.acquire(key)
+		defer self.release(ent)
+	}
+
+	val, _ := ent.dedupSlow(get, time, exp)
+	return val
+}
+
+/*
+Removes the entry for the given key. A concurrent `.Dedup` that has already
+obtained the old entry may still complete on it, but its result is not visible
+to later calls.
+*/
+func (self *Map) Delete(key string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	ent := self.mems[key]
+	if ent != nil {
+		self.remove(ent)
+	}
+}
+
+/*
+Zeroes the state of the entry for the given key, without removing the entry.
+Doesn't create the entry if missing. Doesn't count as an access.
+*/
+func (self *Map) Zero(key string) {
+	ent := self.load(key)
+	if ent != nil {
+		ent.Zero()
+	}
+}
+
+/*
+Calls the given function for each entry, with its key and current state,
+stopping early if the function returns false. Doesn't count as an access.
+Order is unspecified.
+
+This is a best-effort snapshot. The entries are collected under the map's lock,
+but the function is called without holding it, so it may freely call other
+methods of this map. Entries added during iteration may be missed, and entries
+deleted during iteration may still be visited. Each state is read when its
+entry is visited, without waiting for an active writer.
+*/
+func (self *Map) Range(fun func(key string, val Timed) bool) {
+	for _, ent := range self.entries() {
+		if !fun(ent.key, ent.GetTimed()) {
+			return
+		}
+	}
+}
+
+/*
+Returns the current number of entries, including entries with zero states, for
+example after `.Zero`. For maps made by `NewMapLRU`, this may temporarily
+exceed the limit; see `NewMapLRU`.
+*/
+func (self *Map) Len() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.mems)
+}
+
+/*
+Returns a snapshot of the current keys, sorted. Like `.Len`, includes entries
+with zero states. Entries added or deleted afterwards are not reflected.
+*/
+func (self *Map) Keys() []string {
+	self.lock.Lock()
+	out := make([]string, 0, len(self.mems))
+	for key := range self.mems {
+		out = append(out, key)
+	}
+	self.lock.Unlock()
+
+	sort.Strings(out)
+	return out
+}
+
+func (self *Map) entries() []*mapEntry {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	out := make([]*mapEntry, 0, len(self.mems))
+	for _, ent := range self.mems {
+		out = append(out, ent)
+	}
+	return out
+}
+
+func (self *Map) load(key string) *mapEntry {
+	val, _ := self.ents.Load(key)
+	ent, _ := val.(*mapEntry)
+	return ent
+}
+
+/*
+Marks a cache hit as recent, for LRU maps. Doesn't wait for the lock, to keep
+hits lock-free; see `NewMapLRU`.
+*/
+func (self *Map) touch(ent *mapEntry) {
+	if self.max <= 0 || !self.lock.TryLock() {
+		return
+	}
+	defer self.lock.Unlock()
+
+	// Nil if the entry was deleted or evicted after the lookup.
+	if ent.elem != nil {
+		self.lru.MoveToFront(ent.elem)
+	}
+}
+
+func (self *Map) acquire(key string) *mapEntry {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	ent := self.mems[key]
+	if ent == nil {
+		ent = &mapEntry{key: key}
+		if self.mems == nil {
+			self.mems = map[string]*mapEntry{}
+		}
+		self.mems[key] = ent
+		self.ents.Store(key, ent)
+
+		if self.max > 0 {
+			ent.elem = self.lru.PushFront(ent)
+			self.evict()
+		}
+	} else if self.max > 0 {
+		self.lru.MoveToFront(ent.elem)
+	}
+
+	if self.max > 0 {
+		ent.refs++
+	}
+	return ent
+}
+
+func (self *Map) release(ent *mapEntry) {
+	if self.max <= 0 {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ent.refs--
+}
+
+// Must be called under lock.
+func (self *Map) evict() {
+	elem := self.lru.Back()
+
+	for len(self.mems) > self.max && elem != nil {
+		prev := elem.Prev()
+		ent := elem.Value.(*mapEntry)
+		if ent.refs == 0 && elem != self.lru.Front() {
+			self.remove(ent)
+		}
+		elem = prev
+	}
+}
+
+// Must be called under lock.
+func (self *Map) remove(ent *mapEntry) {
+	delete(self.mems, ent.key)
+	self.ents.Delete(ent.key)
+	if ent.elem != nil {
+		self.lru.Remove(ent.elem)
+		ent.elem = nil
+	}
+}
+
+type mapEntry struct {
+	Mem
+	key  string
+	elem *list.Element
+	refs int
+}
@@ -0,0 +1,276 @@
+package ded
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Map_Dedup_independent_keys(t *testing.T) {
+	var tar Map
+	inst := Inst(testTimes[1])
+
+	eq(t, MakeTimed(10, inst.Time()), tar.Dedup(`one`, Either{10}, inst, nil))
+	eq(t, MakeTimed(20, inst.Time()), tar.Dedup(`two`, Either{20}, inst, nil))
+
+	eq(t, MakeTimed(10, inst.Time()), tar.Dedup(`one`, failGetter(t), failTimer(t), BoolExpirer(false)))
+	eq(t, MakeTimed(30, inst.Time()), tar.Dedup(`two`, Either{30}, inst, BoolExpirer(true)))
+	eq(t, MakeTimed(10, inst.Time()), tar.Dedup(`one`, failGetter(t), failTimer(t), BoolExpirer(false)))
+}
+
+func Test_Map_Dedup_independent_keys_dont_block(t *testing.T) {
+	var tar Map
+	getter := newSlowGetter(`slow`)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		tar.Dedup(`slow`, getter, Void{}, nil)
+	}()
+
+	// The writer holds the lock of its key while it's inside the getter.
+	<-getter.Entered()
+
+	eq(t, MakeTimed(`fast`, time.Time{}), tar.Dedup(`fast`, Either{`fast`}, Void{}, nil))
+	eq(t, false, isDone(done))
+
+	getter.Done()
+	<-done
+	eq(t, MakeTimed(`slow`, time.Time{}), tar.Dedup(`slow`, failGetter(t), failTimer(t), BoolExpirer(false)))
+}
+
+func Test_Map_Dedup_same_key_concurrent(t *testing.T) {
+	var tar Map
+	var calls int64
+
+	getter := GetterFunc(func() interface{} {
+		atomic.AddInt64(&calls, 1)
+		return `val`
+	})
+
+	var wg sync.WaitGroup
+	for range counter(8) {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			eq(t, MakeTimed(`val`, time.Time{}), tar.Dedup(`key`, getter, Void{}, IsZeroExpirer{}))
+		}()
+	}
+	wg.Wait()
+
+	eq(t, int64(1), calls)
+}
+
+func Test_Map_Dedup_hit_lock_free(t *testing.T) {
+	test := func(tar *Map) {
+		t.Helper()
+		tar.Dedup(`one`, Either{10}, Void{}, nil)
+
+		// Simulates another goroutine creating or evicting entries.
+		tar.lock.Lock()
+		defer tar.lock.Unlock()
+
+		eq(t, MakeTimed(10, time.Time{}), tar.Dedup(`one`, failGetter(t), failTimer(t), BoolExpirer(false)))
+	}
+
+	test(new(Map))
+	test(NewMapLRU(2))
+}
+
+func Test_Map_Delete(t *testing.T) {
+	var tar Map
+	tar.Delete(`one`)
+
+	tar.Dedup(`one`, Either{10}, Void{}, nil)
+	tar.Delete(`one`)
+
+	eq(t, Timed{}, tar.Dedup(`one`, nil, nil, BoolExpirer(false)))
+}
+
+func Test_Map_Zero(t *testing.T) {
+	var tar Map
+	tar.Zero(`one`)
+	eq(t, 0, len(tar.mems))
+
+	tar.Dedup(`one`, Either{10}, Void{}, nil)
+	tar.Dedup(`two`, Either{20}, Void{}, nil)
+	tar.Zero(`one`)
+
+	eq(t, Timed{}, tar.Dedup(`one`, nil, nil, BoolExpirer(false)))
+	eq(t, MakeTimed(20, time.Time{}), tar.Dedup(`two`, nil, nil, BoolExpirer(false)))
+}
+
+func Test_Map_Range(t *testing.T) {
+	var tar Map
+	collect := func() map[string]Timed {
+		out := map[string]Timed{}
+		tar.Range(func(key string, val Timed) bool {
+			out[key] = val
+			return true
+		})
+		return out
+	}
+
+	eq(t, map[string]Timed{}, collect())
+
+	tar.Dedup(`one`, Either{10}, Inst(testTimes[1]), nil)
+	tar.Dedup(`two`, Either{20}, nil, nil)
+	tar.Dedup(`three`, GetterFunc(func() interface{} { panic(testErr()) }), nil, nil)
+
+	eq(
+		t,
+		map[string]Timed{
+			`one`:   MakeTimed(10, testTimes[1]),
+			`two`:   MakeTimed(20, time.Time{}),
+			`three`: MakeTimed(testErr(), time.Time{}),
+		},
+		collect(),
+	)
+
+	tar.Delete(`two`)
+	tar.Zero(`three`)
+
+	eq(
+		t,
+		map[string]Timed{`one`: MakeTimed(10, testTimes[1]), `three`: {}},
+		collect(),
+	)
+}
+
+func Test_Map_Range_stop(t *testing.T) {
+	var tar Map
+	for _, key := range []string{`one`, `two`, `three`} {
+		tar.Dedup(key, nil, nil, nil)
+	}
+
+	var calls int
+	tar.Range(func(string, Timed) bool {
+		calls++
+		return false
+	})
+	eq(t, 1, calls)
+}
+
+func Test_Map_Range_reentrant(t *testing.T) {
+	var tar Map
+	tar.Dedup(`one`, Either{10}, nil, nil)
+
+	// The callback may use the map without deadlocking.
+	tar.Range(func(key string, _ Timed) bool {
+		tar.Delete(key)
+		tar.Dedup(`two`, Either{20}, nil, nil)
+		return true
+	})
+
+	eq(t, Timed{}, tar.Dedup(`one`, nil, nil, BoolExpirer(false)))
+	eq(t, MakeTimed(20, time.Time{}), tar.Dedup(`two`, nil, nil, BoolExpirer(false)))
+}
+
+func Test_Map_Len_Keys(t *testing.T) {
+	var tar Map
+	eq(t, 0, tar.Len())
+	eq(t, []string{}, tar.Keys())
+
+	tar.Dedup(`two`, Either{20}, nil, nil)
+	tar.Dedup(`one`, Either{10}, nil, nil)
+	tar.Dedup(`three`, Either{30}, nil, nil)
+	tar.Dedup(`one`, Either{10}, nil, nil)
+	eq(t, 3, tar.Len())
+	eq(t, []string{`one`, `three`, `two`}, tar.Keys())
+
+	// Zeroed entries remain.
+	tar.Zero(`three`)
+	eq(t, 3, tar.Len())
+	eq(t, []string{`one`, `three`, `two`}, tar.Keys())
+
+	tar.Delete(`one`)
+	tar.Delete(`missing`)
+	eq(t, 2, tar.Len())
+	eq(t, []string{`three`, `two`}, tar.Keys())
+
+	lru := NewMapLRU(2)
+	lru.Dedup(`one`, nil, nil, nil)
+	lru.Dedup(`two`, nil, nil, nil)
+	lru.Dedup(`three`, nil, nil, nil)
+	eq(t, 2, lru.Len())
+	eq(t, []string{`three`, `two`}, lru.Keys())
+}
+
+func Test_Map_Len_Keys_concurrent(t *testing.T) {
+	var tar Map
+	keys := []string{`one`, `two`, `three`, `four`}
+
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Add(-1)
+			for range counter(64) {
+				tar.Dedup(key, nil, nil, nil)
+				eq(t, true, tar.Len() <= len(keys))
+				eq(t, true, len(tar.Keys()) <= len(keys))
+				tar.Delete(key)
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	eq(t, 0, tar.Len())
+	eq(t, []string{}, tar.Keys())
+}
+
+func Test_NewMapLRU_evicts_coldest(t *testing.T) {
+	tar := NewMapLRU(2)
+
+	tar.Dedup(`one`, Either{10}, Void{}, nil)
+	tar.Dedup(`two`, Either{20}, Void{}, nil)
+
+	// Accessing `one` makes `two` the coldest key.
+	tar.Dedup(`one`, failGetter(t), failTimer(t), BoolExpirer(false))
+	tar.Dedup(`three`, Either{30}, Void{}, nil)
+
+	eq(t, 2, len(tar.mems))
+	eq(t, MakeTimed(10, time.Time{}), tar.Dedup(`one`, failGetter(t), failTimer(t), BoolExpirer(false)))
+	eq(t, MakeTimed(30, time.Time{}), tar.Dedup(`three`, failGetter(t), failTimer(t), BoolExpirer(false)))
+
+	// `two` was evicted, and starts over from zero.
+	eq(t, Timed{}, tar.Dedup(`two`, nil, nil, BoolExpirer(false)))
+
+	// Re-adding `two` evicted `one`, the coldest.
+	eq(t, Timed{}, tar.Dedup(`one`, nil, nil, BoolExpirer(false)))
+}
+
+func Test_NewMapLRU_doesnt_evict_busy(t *testing.T) {
+	tar := NewMapLRU(1)
+	getter := newSlowGetter(`slow`)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		tar.Dedup(`slow`, getter, Void{}, nil)
+	}()
+
+	// The writer's entry is registered and in use while it's inside the getter.
+	<-getter.Entered()
+
+	tar.Dedup(`fast`, Either{`fast`}, Void{}, nil)
+	eq(t, 2, len(tar.mems))
+
+	getter.Done()
+	<-done
+
+	// Once the writer is done, the busy key becomes evictable again.
+	tar.Dedup(`other`, Either{`other`}, Void{}, nil)
+	eq(t, 1, len(tar.mems))
+	eq(t, MakeTimed(`other`, time.Time{}), tar.Dedup(`other`, failGetter(t), failTimer(t), BoolExpirer(false)))
+}
+
+func Test_NewMapLRU_Delete(t *testing.T) {
+	tar := NewMapLRU(2)
+	tar.Dedup(`one`, Either{10}, Void{}, nil)
+	tar.Delete(`one`)
+
+	eq(t, 0, len(tar.mems))
+	eq(t, 0, tar.lru.Len())
+}
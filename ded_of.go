@@ -0,0 +1,282 @@
+package ded
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Typed variant of `Getter`, used by `MemOf`. Follows the same rules as `Getter`,
+except that errors can be communicated only by panicking, since `T` doesn't
+have to implement `error`.
+*/
+type GetterOf[T any] interface{ Get() T }
+
+/*
+Creates an instance of `MemOf` with the given value and time. Typed variant of
+`NewMem`. Defined mostly for tests.
+*/
+func NewMemOf[T any](val TimedOf[T]) *MemOf[T] {
+	var out MemOf[T]
+	out.ptr.Store(&val)
+	return &out
+}
+
+/*
+Typed variant of `Mem`. Stores `TimedOf[T]` instead of `Timed`, avoiding type
+assertions and, for non-pointer types, interface boxing of the cached value.
+Has the same concurrency semantics as `Mem`: reads are lock-free, using an
+`atomic.Pointer`, and don't wait for an active writer, while writers are
+serialized by a mutex. The zero value is ready to use, but must not be copied
+(use it by pointer).
+
+Expiration is still determined by the non-generic `Expirer`, which receives
+`TimedOf[T].Timed()`. For non-pointer types, that conversion boxes the value,
+which may allocate. The expirers of this package that test only the timestamp,
+such as `Duration`, `Inst` and `NowExpirer`, receive a substitute without the
+value instead, which doesn't allocate. Other expirers, including compositions
+such as `ExpirerOr`, receive the full conversion.
+*/
+type MemOf[T any] struct {
+	lock sync.Mutex
+	ptr  atomic.Pointer[TimedOf[T]]
+}
+
+/*
+Shorthand for `.GetTimed().Get()`. Typed variant of `(*Mem).Get`. If an error
+is currently cached, panics with that error.
+*/
+func (self *MemOf[T]) Get() T { return self.GetTimed().Get() }
+
+// Typed variant of `(*Mem).GetTimed`.
+func (self *MemOf[T]) GetTimed() TimedOf[T] {
+	val := self.ptr.Load()
+	if val != nil {
+		return *val
+	}
+	return TimedOf[T]{}
+}
+
+// Typed variant of `(*Mem).SetTimed`.
+func (self *MemOf[T]) SetTimed(val TimedOf[T]) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.ptr.Store(&val)
+}
+
+// Zeroes the state, resetting it to `TimedOf[T]{}`.
+func (self *MemOf[T]) Zero() { self.SetTimed(TimedOf[T]{}) }
+
+// Typed variant of `(*Mem).Dedup`. See that method for the details.
+func (self *MemOf[T]) Dedup(get GetterOf[T], time Timer, exp Expirer) TimedOf[T] {
+	val := self.GetTimed()
+	if !isExpiredOf(exp, val) {
+		return val
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// Separate variable, because escaping to the heap would make the fast
+	// path above allocate.
+	next := self.GetTimed()
+	if !isExpiredOf(exp, next) {
+		return next
+	}
+
+	next.SetGetter(get)
+	next.SetTimer(time)
+	self.ptr.Store(&next)
+	return next
+}
+
+// Implement `fmt.GoStringer` for debug purposes.
+func (self *MemOf[T]) GoString() string {
+	return fmt.Sprintf(`ded.NewMemOf(%#v)`, self.GetTimed())
+}
+
+/*
+Typed variant of `Either`. Represents either value or error. Unlike `Either`,
+the error is stored separately from the value, because `T` doesn't have to
+implement `error`. When `.Err` is non-nil, `.Val` is always zero. The zero
+value unwraps to `(zeroT, nil)`.
+*/
+type EitherOf[T any] struct {
+	Val T
+	Err error
+}
+
+// If `.Err` is non-nil, panics with that error. Otherwise returns `.Val`.
+func (self EitherOf[T]) Get() T {
+	if self.Err != nil {
+		panic(self.Err)
+	}
+	return self.Val
+}
+
+// Returns `(zeroT, err)` if `.Err` is non-nil, otherwise `(val, nil)`.
+func (self EitherOf[T]) Unwrap() (T, error) {
+	if self.Err != nil {
+		var zero T
+		return zero, self.Err
+	}
+	return self.Val, nil
+}
+
+// Replaces the inner value, clearing the error.
+func (self *EitherOf[T]) Set(val T) {
+	self.Val = val
+	self.Err = nil
+}
+
+// Replaces the inner error, clearing the value. Nil error is equivalent to
+// `.Set(zeroT)`.
+func (self *EitherOf[T]) SetErr(err error) {
+	var zero T
+	self.Val = zero
+	self.Err = err
+}
+
+/*
+Replaces the inner value by calling the provided getter. Nil getter is ok and
+considered to have the zero value. If the getter panics, the panic is caught
+and stored in `.Err`, converting non-error panics into errors.
+*/
+func (self *EitherOf[T]) SetGetter(val GetterOf[T]) {
+	if val == nil {
+		self.SetErr(nil)
+		return
+	}
+
+	defer self.rec()
+	self.Set(val.Get())
+}
+
+// Must be deferred.
+func (self *EitherOf[T]) rec() {
+	val := recover()
+	if val != nil {
+		self.SetErr(toErr(val))
+	}
+}
+
+// Shortcut for constructing `TimedOf`. Typed variant of `MakeTimed`.
+func MakeTimedOf[T any](val T, inst time.Time) TimedOf[T] {
+	return TimedOf[T]{EitherOf[T]{Val: val}, inst}
+}
+
+/*
+Typed variant of `Timed`. Combination of a value or error, and a timestamp.
+Produced and stored by `MemOf`. The inner value is stored in `.EitherOf`; see
+the `EitherOf` docs.
+*/
+type TimedOf[T any] struct {
+	EitherOf[T]
+	Time time.Time
+}
+
+/*
+Replaces the timestamp by calling `val.Time()`. Nil timer is ok, equivalent to
+`time.Time{}`. If the timer panics, the resulting error replaces the inner
+value, while the timestamp is unaffected.
+*/
+func (self *TimedOf[T]) SetTimer(val Timer) {
+	if val == nil {
+		self.Time = time.Time{}
+		return
+	}
+
+	defer self.rec()
+	self.Time = val.Time()
+}
+
+/*
+Converts to the non-generic `Timed`, storing either `.Err` or `.Val` as the
+inner value. Used for passing typed values to `Expirer`.
+*/
+func (self TimedOf[T]) Timed() Timed {
+	if self.Err != nil {
+		return MakeTimed(self.Err, self.Time)
+	}
+	return MakeTimed(self.Val, self.Time)
+}
+
+func isExpiredOf[T any](exp Expirer, val TimedOf[T]) bool {
+	if exp == nil {
+		return true
+	}
+	if isTimeExpirer(exp) {
+		return exp.IsExpired(val.timedShallow())
+	}
+	return exp.IsExpired(val.Timed())
+}
+
+/*
+Converts to `Timed` without boxing the inner value, for expirers that look only
+at the timestamp and at `Timed.IsZero`. A non-nil value is replaced with a
+zero-sized placeholder, which preserves the result of `.IsZero`.
+*/
+func (self TimedOf[T]) timedShallow() Timed {
+	if self.Err != nil {
+		return MakeTimed(self.Err, self.Time)
+	}
+	if isNilAny(self.Val) {
+		return Timed{Time: self.Time}
+	}
+	return MakeTimed(valuePlaceholder{}, self.Time)
+}
+
+type valuePlaceholder struct{}
+
+// True if boxing the value produces a nil interface. Doesn't escape, and
+// therefore doesn't allocate.
+func isNilAny[T any](val T) bool { return interface{}(val) == nil }
+
+/*
+True for the expirers of this package that look only at the timestamp and at
+`Timed.IsZero`, and never at the inner value.
+*/
+func isTimeExpirer(exp Expirer) bool {
+	switch exp.(type) {
+	case Duration, Inst, NowExpirer, nowExpirerClock, durationClock,
+		Void, ExpireSecond, ExpireMinute, ExpireHour, ExpireDay, ExpireWeek,
+		ExpireMonth, ExpireNever, DurationJitter, Window, RefreshAhead,
+		SampledExpirer, ExpireAt, Tiered, FileModExpirer, *CountExpirer,
+		*FlagExpirer:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+Calls `mem.Get` and asserts the result to `T`. If an error is currently cached,
+panics with that error, just like `(*Mem).Get`. If the cached value isn't a
+`T`, panics with an error describing the expected and the actual type. Follows
+the rules of Go type assertions: nil matches no type. Shortcut for code that
+uses the non-generic `Mem`; see `MemOf` for a fully typed alternative.
+*/
+func MustGet[T any](mem *Mem) T {
+	val := mem.Get()
+	out, ok := val.(T)
+	if !ok {
+		panic(fmt.Errorf(`[ded] expected cached value of type %v, found %T`, typeOf[T](), val))
+	}
+	return out
+}
+
+/*
+Calls `mem.Get` and asserts the result to `T`, returning false if the cached
+value isn't a `T`. If an error is currently cached, panics with that error,
+just like `(*Mem).Get`. Follows the rules of Go type assertions: nil matches no
+type.
+*/
+func GetAs[T any](mem *Mem) (T, bool) {
+	out, ok := mem.Get().(T)
+	return out, ok
+}
+
+func typeOf[T any]() reflect.Type { return reflect.TypeOf((*T)(nil)).Elem() }
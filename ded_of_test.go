@@ -0,0 +1,233 @@
+package ded
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type testGetterOf[T any] struct{ val T }
+
+func (self testGetterOf[T]) Get() T { return self.val }
+
+type panicGetterOf[T any] struct{ val interface{} }
+
+func (self panicGetterOf[T]) Get() T { panic(self.val) }
+
+type funcGetterOf[T any] func() T
+
+func (self funcGetterOf[T]) Get() T { return self() }
+
+func errTimedOf[T any](err error, inst time.Time) TimedOf[T] {
+	return TimedOf[T]{EitherOf[T]{Err: err}, inst}
+}
+
+func Test_EitherOf_Get(t *testing.T) {
+	eq(t, 10, EitherOf[int]{Val: 10}.Get())
+	eq(t, ``, EitherOf[string]{}.Get())
+
+	err := testErr()
+	panics(t, err, func() { EitherOf[int]{Err: err}.Get() })
+}
+
+func Test_EitherOf_Unwrap(t *testing.T) {
+	test := func(src EitherOf[*int], expVal *int, expErr error) {
+		t.Helper()
+		val, err := src.Unwrap()
+		eq(t, expVal, val)
+		eq(t, expErr, err)
+	}
+
+	test(EitherOf[*int]{}, nil, nil)
+
+	num := new(int)
+	test(EitherOf[*int]{Val: num}, num, nil)
+
+	err := testErr()
+	test(EitherOf[*int]{Err: err}, nil, err)
+}
+
+func Test_EitherOf_Set(t *testing.T) {
+	tar := EitherOf[int]{Err: testErr()}
+	tar.Set(10)
+	eq(t, EitherOf[int]{Val: 10}, tar)
+
+	err := testErr()
+	tar.SetErr(err)
+	eq(t, EitherOf[int]{Err: err}, tar)
+}
+
+func Test_EitherOf_SetGetter(t *testing.T) {
+	test := func(exp EitherOf[int], get GetterOf[int]) {
+		t.Helper()
+		tar := EitherOf[int]{Val: 20, Err: testErr()}
+		tar.SetGetter(get)
+		eq(t, exp, tar)
+	}
+
+	test(EitherOf[int]{}, nil)
+	test(EitherOf[int]{Val: 10}, testGetterOf[int]{10})
+
+	err := testErr()
+	test(EitherOf[int]{Err: err}, panicGetterOf[int]{err})
+
+	var tar EitherOf[int]
+	tar.SetGetter(panicGetterOf[int]{`some string`})
+	eq(t, 0, tar.Val)
+	eqPanicErr(t, `some string`, tar.Err)
+}
+
+func Test_TimedOf_SetTimer(t *testing.T) {
+	for _, inst := range testTimes {
+		tar := MakeTimedOf(10, time.Now())
+		tar.SetTimer(Inst(inst))
+		eq(t, MakeTimedOf(10, inst), tar)
+	}
+
+	tar := MakeTimedOf(10, time.Now())
+	tar.SetTimer(nil)
+	eq(t, MakeTimedOf(10, time.Time{}), tar)
+}
+
+func Test_TimedOf_Timed(t *testing.T) {
+	inst := testTimes[1]
+	eq(t, MakeTimed(10, inst), MakeTimedOf(10, inst).Timed())
+
+	err := testErr()
+	eq(t, MakeTimed(err, inst), errTimedOf[int](err, inst).Timed())
+}
+
+func Test_MemOf_Get(t *testing.T) {
+	eq(t, (*int)(nil), new(MemOf[*int]).Get())
+	eq(t, `val`, NewMemOf(MakeTimedOf(`val`, time.Time{})).Get())
+
+	err := testErr()
+	panics(t, err, func() { NewMemOf(errTimedOf[string](err, time.Time{})).Get() })
+}
+
+func Test_MemOf_SetTimed(t *testing.T) {
+	var mem MemOf[string]
+	mem.SetTimed(MakeTimedOf(`val`, testTimes[1]))
+	eq(t, MakeTimedOf(`val`, testTimes[1]), mem.GetTimed())
+
+	mem.Zero()
+	eq(t, TimedOf[string]{}, mem.GetTimed())
+}
+
+func Test_MemOf_Dedup(t *testing.T) {
+	var mem MemOf[string]
+	inst := Inst(testTimes[1])
+
+	eq(
+		t,
+		MakeTimedOf(`one`, inst.Time()),
+		mem.Dedup(testGetterOf[string]{`one`}, inst, BoolExpirer(true)),
+	)
+
+	eq(
+		t,
+		MakeTimedOf(`one`, inst.Time()),
+		mem.Dedup(testGetterOf[string]{`two`}, Void{}, BoolExpirer(false)),
+	)
+
+	err := testErr()
+	eq(
+		t,
+		errTimedOf[string](err, inst.Time()),
+		mem.Dedup(panicGetterOf[string]{err}, inst, nil),
+	)
+
+	panics(t, err, func() { mem.Get() })
+}
+
+func Test_MemOf_Dedup_readers_during_regeneration(t *testing.T) {
+	oldTimed := MakeTimedOf(`old value`, testTimes[1])
+	newTimed := MakeTimedOf(`new value`, testTimes[1].Add(time.Second))
+	mem := NewMemOf(oldTimed)
+	slow := newSlowGetter(newTimed.Val)
+	getter := funcGetterOf[string](func() string { return slow.Get().(string) })
+	writerDone := make(chan struct{})
+
+	go func() {
+		defer close(writerDone)
+		mem.Dedup(getter, Inst(newTimed.Time), BoolExpirer(true))
+	}()
+	<-slow.Entered()
+
+	// Readers don't wait for the active writer.
+	eq(t, oldTimed, mem.GetTimed())
+	eq(t, oldTimed, mem.Dedup(testGetterOf[string]{`unused`}, failTimer(t), BoolExpirer(false)))
+
+	slow.Done()
+	<-writerDone
+	eq(t, newTimed, mem.GetTimed())
+}
+
+func Test_TimedOf_timedShallow(t *testing.T) {
+	testTimedShallow(t, TimedOf[int]{})
+	testTimedShallow(t, TimedOf[*int]{})
+	testTimedShallow(t, TimedOf[error]{})
+	testTimedShallow(t, TimedOf[interface{}]{})
+	testTimedShallow(t, MakeTimedOf[interface{}](10, time.Time{}))
+	testTimedShallow(t, MakeTimedOf(10, testTimes[1]))
+	testTimedShallow(t, MakeTimedOf([]int(nil), testTimes[1]))
+	testTimedShallow(t, errTimedOf[int](testErr(), time.Time{}))
+}
+
+func testTimedShallow[T any](t testing.TB, val TimedOf[T]) {
+	t.Helper()
+	out := val.timedShallow()
+	eq(t, val.Timed().IsZero(), out.IsZero())
+	eq(t, val.Timed().Err(), out.Err())
+	eq(t, val.Time, out.Time)
+}
+
+func Test_MemOf_Dedup_hit_doesnt_alloc(t *testing.T) {
+	mem := NewMemOf(MakeTimedOf([]int{10}, time.Now()))
+
+	test := func(exp Expirer) {
+		t.Helper()
+		eq(t, float64(0), testing.AllocsPerRun(100, func() { mem.Dedup(nil, nil, exp) }))
+		eq(t, []int{10}, mem.Get())
+	}
+
+	test(Duration(time.Hour))
+	test(ExpireHour{})
+	test(ExpireNever{})
+	test(&CountExpirer{Max: 1000})
+}
+
+func Test_MustGet(t *testing.T) {
+	eq(t, 10, MustGet[int](NewMem(MakeTimed(10, testTimes[1]))))
+	eq(t, `str`, MustGet[string](NewMem(MakeTimed(`str`, testTimes[1]))))
+	eq(t, fmt.Stringer(Inst{}), MustGet[fmt.Stringer](NewMem(MakeTimed(Inst{}, testTimes[1]))))
+}
+
+func Test_MustGet_mismatch(t *testing.T) {
+	panics(t, fmt.Errorf(`[ded] expected cached value of type int, found string`), func() {
+		MustGet[int](NewMem(MakeTimed(`str`, testTimes[1])))
+	})
+
+	panics(t, fmt.Errorf(`[ded] expected cached value of type fmt.Stringer, found <nil>`), func() {
+		MustGet[fmt.Stringer](new(Mem))
+	})
+}
+
+func Test_MustGet_err(t *testing.T) {
+	panics(t, testErr(), func() { MustGet[int](NewMem(MakeTimed(testErr(), testTimes[1]))) })
+}
+
+func Test_GetAs(t *testing.T) {
+	test := func(mem *Mem, expVal int, expOk bool) {
+		t.Helper()
+		val, ok := GetAs[int](mem)
+		eq(t, expVal, val)
+		eq(t, expOk, ok)
+	}
+
+	test(NewMem(MakeTimed(10, testTimes[1])), 10, true)
+	test(NewMem(MakeTimed(`str`, testTimes[1])), 0, false)
+	test(new(Mem), 0, false)
+
+	panics(t, testErr(), func() { GetAs[int](NewMem(MakeTimed(testErr(), testTimes[1]))) })
+}
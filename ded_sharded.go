@@ -0,0 +1,91 @@
+package ded
+
+/*
+Creates a `Sharded` with the given number of shards, using the given hash
+function to assign keys to shards. Zero or negative count is treated as 1. Nil
+hash function uses FNV-1a.
+*/
+func NewSharded(count int, hash func(string) uint64) *Sharded {
+	return NewShardedLRU(count, 0, hash)
+}
+
+/*
+Same as `NewSharded`, but each shard is limited to the given number of entries,
+like a `Map` created by `NewMapLRU`. The limit is per shard, so the total
+number of entries is at most `count * maxEntries`, except when keys are busy;
+see `NewMapLRU`. Because keys are distributed by hashing, a shard may evict
+its least-recently-used key while other shards still have room. Zero or
+negative limit means no limit.
+*/
+func NewShardedLRU(count, maxEntries int, hash func(string) uint64) *Sharded {
+	if count <= 0 {
+		count = 1
+	}
+
+	shards := make([]Map, count)
+	for i := range shards {
+		shards[i].max = maxEntries
+	}
+	return &Sharded{shards: shards, hash: hash}
+}
+
+/*
+Keyed collection of `Mem`, like `Map`, but split into multiple independent
+shards, each with its own lock. Keys are assigned to shards by hashing. Within
+a shard, behaves exactly like `Map`: each key has its own `Mem`, and distinct
+keys never wait for each other's getters.
+
+Useful when many goroutines frequently create, delete or evict keys, for
+example in a size-bounded cache made by `NewShardedLRU` whose working set
+exceeds its limit, where the single lock of `Map`, held during these
+operations, becomes a bottleneck. Cache hits of `Map` are already lock-free, so
+for workloads dominated by hits on a stable set of keys, sharding only adds
+the cost of hashing; prefer a plain `Map`.
+
+The zero value is ready to use, but has only one shard, behaving like a plain
+`Map`; use `NewSharded` to specify the shard count. Must not be copied (use it
+by pointer). All methods of `*Sharded` are concurrency-safe.
+*/
+type Sharded struct {
+	shards []Map
+	hash   func(string) uint64
+	single Map // Used by the zero value, which has no shards.
+}
+
+/*
+Same as `(*Map).Dedup` on the shard that owns the given key.
+*/
+func (self *Sharded) Dedup(key string, get Getter, time Timer, exp Expirer) Timed {
+	return self.shard(key).Dedup(key, get, time, exp)
+}
+
+// Same as `(*Map).Delete` on the shard that owns the given key.
+func (self *Sharded) Delete(key string) { self.shard(key).Delete(key) }
+
+// Same as `(*Map).Zero` on the shard that owns the given key.
+func (self *Sharded) Zero(key string) { self.shard(key).Zero(key) }
+
+func (self *Sharded) shard(key string) *Map {
+	if len(self.shards) == 0 {
+		return &self.single
+	}
+	return &self.shards[self.hashKey(key)%uint64(len(self.shards))]
+}
+
+func (self *Sharded) hashKey(key string) uint64 {
+	if self.hash != nil {
+		return self.hash(key)
+	}
+	return fnv64a(key)
+}
+
+// Inline FNV-1a, avoiding the allocations of `hash/fnv`.
+func fnv64a(src string) uint64 {
+	const prime = 1099511628211
+	out := uint64(14695981039346656037)
+	for i := 0; i < len(src); i++ {
+		out ^= uint64(src[i])
+		out *= prime
+	}
+	return out
+}
@@ -0,0 +1,152 @@
+package ded
+
+import (
+	"hash/fnv"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_NewSharded(t *testing.T) {
+	eq(t, 1, len(NewSharded(0, nil).shards))
+	eq(t, 1, len(NewSharded(-1, nil).shards))
+	eq(t, 8, len(NewSharded(8, nil).shards))
+	eq(t, 0, NewSharded(8, nil).shards[0].max)
+}
+
+func Test_NewShardedLRU(t *testing.T) {
+	tar := NewShardedLRU(2, 2, func(key string) uint64 {
+		val, _ := strconv.ParseUint(key, 10, 64)
+		return val
+	})
+
+	for i := range counter(8) {
+		tar.Dedup(strconv.Itoa(i), Either{i}, Void{}, nil)
+	}
+
+	// Each shard keeps its own most recent keys.
+	eq(t, []string{`4`, `6`}, tar.shards[0].Keys())
+	eq(t, []string{`5`, `7`}, tar.shards[1].Keys())
+	eq(t, MakeTimed(6, time.Time{}), tar.Dedup(`6`, failGetter(t), failTimer(t), BoolExpirer(false)))
+	eq(t, Timed{}, tar.Dedup(`0`, nil, nil, BoolExpirer(false)))
+}
+
+func Test_Sharded_Dedup(t *testing.T) {
+	tar := NewSharded(4, nil)
+	inst := Inst(testTimes[1])
+
+	eq(t, MakeTimed(10, inst.Time()), tar.Dedup(`one`, Either{10}, inst, nil))
+	eq(t, MakeTimed(20, inst.Time()), tar.Dedup(`two`, Either{20}, inst, nil))
+	eq(t, MakeTimed(10, inst.Time()), tar.Dedup(`one`, failGetter(t), failTimer(t), BoolExpirer(false)))
+	eq(t, MakeTimed(20, inst.Time()), tar.Dedup(`two`, failGetter(t), failTimer(t), BoolExpirer(false)))
+
+	tar.Zero(`one`)
+	eq(t, Timed{}, tar.Dedup(`one`, nil, nil, BoolExpirer(false)))
+
+	tar.Delete(`two`)
+	eq(t, Timed{}, tar.Dedup(`two`, nil, nil, BoolExpirer(false)))
+}
+
+func Test_Sharded_zero(t *testing.T) {
+	var tar Sharded
+	inst := Inst(testTimes[1])
+
+	eq(t, MakeTimed(10, inst.Time()), tar.Dedup(`one`, Either{10}, inst, nil))
+	eq(t, MakeTimed(20, inst.Time()), tar.Dedup(`two`, Either{20}, inst, nil))
+	eq(t, MakeTimed(10, inst.Time()), tar.Dedup(`one`, failGetter(t), failTimer(t), BoolExpirer(false)))
+	eq(t, 2, tar.single.Len())
+
+	tar.Zero(`one`)
+	eq(t, Timed{}, tar.Dedup(`one`, nil, nil, BoolExpirer(false)))
+
+	tar.Delete(`two`)
+	eq(t, Timed{}, tar.Dedup(`two`, nil, nil, BoolExpirer(false)))
+}
+
+func Test_Sharded_distributes_keys(t *testing.T) {
+	tar := NewSharded(4, func(key string) uint64 {
+		val, _ := strconv.ParseUint(key, 10, 64)
+		return val
+	})
+
+	for i := range counter(8) {
+		tar.Dedup(strconv.Itoa(i), Either{i}, Void{}, nil)
+	}
+
+	for i := range tar.shards {
+		eq(t, 2, len(tar.shards[i].mems))
+	}
+}
+
+func Test_Sharded_shards_dont_block(t *testing.T) {
+	tar := NewSharded(2, func(key string) uint64 {
+		val, _ := strconv.ParseUint(key, 10, 64)
+		return val
+	})
+
+	// Holding the lock of one shard doesn't affect keys in other shards.
+	tar.shards[0].lock.Lock()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		tar.Dedup(`2`, Either{2}, Void{}, nil)
+	}()
+
+	eq(t, MakeTimed(1, time.Time{}), tar.Dedup(`1`, Either{1}, Void{}, nil))
+
+	// The other call can't finish while its shard is locked. The sleep merely
+	// gives it a chance to reach the lock.
+	time.Sleep(time.Millisecond)
+	eq(t, false, isDone(done))
+
+	tar.shards[0].lock.Unlock()
+	<-done
+}
+
+func Test_fnv64a(t *testing.T) {
+	for _, key := range []string{``, `one`, `two`, `some longer key`} {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		eq(t, hash.Sum64(), fnv64a(key))
+	}
+}
+
+var benchKeys = func() (out []string) {
+	for i := range counter(1024) {
+		out = append(out, strconv.Itoa(i))
+	}
+	return
+}()
+
+func Benchmark_Map_Dedup_parallel(b *testing.B) {
+	var tar Map
+	benchKeyedParallel(b, tar.Dedup)
+}
+
+func Benchmark_Sharded_Dedup_parallel(b *testing.B) {
+	benchKeyedParallel(b, NewSharded(64, nil).Dedup)
+}
+
+/*
+Unlike the benchmarks above, which measure lock-free hits, these measure the
+create/evict path, where `Map` takes its lock on every call. The working set is
+larger than the limit, and cycling through it makes every call evict.
+*/
+func Benchmark_Map_Dedup_evicting_parallel(b *testing.B) {
+	benchKeyedParallel(b, NewMapLRU(len(benchKeys)/4).Dedup)
+}
+
+func Benchmark_Sharded_Dedup_evicting_parallel(b *testing.B) {
+	benchKeyedParallel(b, NewShardedLRU(64, len(benchKeys)/4/64, nil).Dedup)
+}
+
+func benchKeyedParallel(b *testing.B, fun func(string, Getter, Timer, Expirer) Timed) {
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			fun(benchKeys[i%len(benchKeys)], GetterFunc(staticGetter), Void{}, BoolExpirer(false))
+			i++
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package ded
+
+import (
+	"encoding/json"
+	"time"
+)
+
+/*
+Serializable description of the state of a `Mem`, produced by
+`(*Mem).Snapshot`. Meant for debug dashboards and API responses that expose
+cache metadata.
+
+`.Value` is the cached value, or nil if an error is cached, in which case
+`.Error` is its message. `.FetchedAt` is the cached timestamp. `.Expired` is
+the result of the expirer at the time of the snapshot. `.ExpiresAt` is known
+only when the expirer is a `Duration`, and only for states with a timestamp;
+otherwise it's zero and omitted from JSON, along with an empty `.Error`.
+*/
+type Snapshot struct {
+	Value     interface{}
+	Error     string
+	FetchedAt time.Time
+	Expired   bool
+	ExpiresAt time.Time
+}
+
+/*
+Returns a `Snapshot` of the current state, using the given expirer to determine
+expiration. Follows the same rules as `IsExpired`: nil expirer is considered
+to always expire.
+*/
+func (self *Mem) Snapshot(exp Expirer) Snapshot {
+	val := self.GetTimed()
+
+	var out Snapshot
+	err := val.Err()
+	if err != nil {
+		out.Error = err.Error()
+	} else {
+		out.Value = val.Either[0]
+	}
+	out.FetchedAt = val.Time
+	out.Expired = IsExpired(exp, val)
+
+	dur, ok := exp.(Duration)
+	if ok && !val.Time.IsZero() {
+		out.ExpiresAt = val.Time.Add(dur.Duration())
+	}
+	return out
+}
+
+/*
+Implement `json.Marshaler`, omitting the empty `.Error` and the zero
+`.ExpiresAt`, which the "omitempty" option can't do for `time.Time`.
+*/
+func (self Snapshot) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonSnapshot{
+		Value:     self.Value,
+		Error:     self.Error,
+		FetchedAt: self.FetchedAt,
+		Expired:   self.Expired,
+		ExpiresAt: timeOpt(self.ExpiresAt),
+	})
+}
+
+type jsonSnapshot struct {
+	Value     interface{}
+	Error     string `json:",omitempty"`
+	FetchedAt time.Time
+	Expired   bool
+	ExpiresAt *time.Time `json:",omitempty"`
+}
+
+func timeOpt(val time.Time) *time.Time {
+	if val.IsZero() {
+		return nil
+	}
+	return &val
+}
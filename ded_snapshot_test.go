@@ -0,0 +1,66 @@
+package ded
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func Test_Mem_Snapshot(t *testing.T) {
+	var mem Mem
+	eq(t, Snapshot{Expired: true}, mem.Snapshot(nil))
+	eq(t, Snapshot{Expired: true}, mem.Snapshot(Duration(time.Hour)))
+
+	fresh := time.Date(2100, 1, 2, 3, 4, 5, 0, time.UTC)
+	mem.SetTimed(MakeTimed(`val`, fresh))
+
+	eq(t, Snapshot{Value: `val`, FetchedAt: fresh}, mem.Snapshot(BoolExpirer(false)))
+	eq(
+		t,
+		Snapshot{Value: `val`, FetchedAt: fresh, ExpiresAt: fresh.Add(time.Hour)},
+		mem.Snapshot(Duration(time.Hour)),
+	)
+
+	stale := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	mem.SetTimed(MakeTimed(testErr(), stale))
+
+	eq(
+		t,
+		Snapshot{Error: `some error`, FetchedAt: stale, Expired: true, ExpiresAt: stale.Add(time.Hour)},
+		mem.Snapshot(ExpireAfter(time.Hour)),
+	)
+}
+
+func Test_Snapshot_MarshalJSON(t *testing.T) {
+	test := func(exp string, val Snapshot) {
+		t.Helper()
+		src, err := json.Marshal(val)
+		eq(t, nil, err)
+		eq(t, exp, string(src))
+	}
+
+	test(
+		`{"Value":null,"FetchedAt":"0001-01-01T00:00:00Z","Expired":true}`,
+		Snapshot{Expired: true},
+	)
+
+	var mem Mem
+	mem.SetTimed(MakeTimed(10, time.Date(2100, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	test(
+		`{"Value":10,"FetchedAt":"2100-01-02T03:04:05Z","Expired":false,"ExpiresAt":"2100-01-02T04:04:05Z"}`,
+		mem.Snapshot(Duration(time.Hour)),
+	)
+
+	test(
+		`{"Value":10,"FetchedAt":"2100-01-02T03:04:05Z","Expired":false}`,
+		mem.Snapshot(BoolExpirer(false)),
+	)
+
+	mem.SetTimed(MakeTimed(testErr(), time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	test(
+		`{"Value":null,"Error":"some error","FetchedAt":"2000-01-02T03:04:05Z","Expired":true,"ExpiresAt":"2000-01-02T04:04:05Z"}`,
+		mem.Snapshot(Duration(time.Hour)),
+	)
+}
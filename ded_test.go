@@ -1,8 +1,18 @@
 package ded
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
 	"reflect"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -41,6 +51,28 @@ func Test_Either_Set(t *testing.T) {
 	}
 }
 
+func Test_Either_Equal(t *testing.T) {
+	for _, one := range testVals {
+		for _, two := range testVals {
+			eq(t, reflect.DeepEqual(one, two), Either{one}.Equal(Either{two}))
+		}
+	}
+
+	eq(t, true, Either{[]int{1}}.Equal(Either{[]int{1}}))
+	eq(t, false, Either{[]int{1}}.Equal(Either{[]int{2}}))
+	eq(t, false, Either{[]int{1}}.Equal(Either{[]int64{1}}))
+	eq(t, false, Either{[]int{1}}.Equal(Either{}))
+
+	// The same comparison via `==` panics.
+	func() {
+		defer func() {
+			_, ok := recover().(runtime.Error)
+			eq(t, true, ok)
+		}()
+		_ = Either{[]int{1}} == Either{[]int{1}}
+	}()
+}
+
 func Test_Either_SetGetter(t *testing.T) {
 	test := func(val interface{}) {
 		var tar Either
@@ -53,6 +85,109 @@ func Test_Either_SetGetter(t *testing.T) {
 	}
 }
 
+func Test_Either_SetGetter_panic(t *testing.T) {
+	var tar Either
+
+	err := testErr()
+	tar.SetGetter(GetterFunc(func() interface{} { panic(err) }))
+	eq(t, Either{err}, tar)
+
+	tar.SetGetter(GetterFunc(panicWithString))
+	eqPanicErr(t, `some string`, tar[0])
+	eq(t, `some string`, tar[0].(error).Error())
+	eq(t, true, bytes.Contains(tar[0].(*PanicError).Stack, []byte(`panicWithString`)))
+	panics(t, tar[0], func() { tar.Get() })
+
+	_, outErr := tar.Unwrap()
+	eq(t, tar[0], outErr)
+}
+
+func panicWithString() interface{} { panic(`some string`) }
+
+func Test_Timed_SetTimer_panic(t *testing.T) {
+	tar := MakeTimed(10, testTimes[1])
+	tar.SetTimer(TimerFunc(func() time.Time { panic(`some string`) }))
+	eqPanicErr(t, `some string`, tar.Err())
+	eq(t, testTimes[1], tar.Time)
+}
+
+func Test_Either_Map(t *testing.T) {
+	double := func(val interface{}) interface{} { return val.(int) * 2 }
+
+	eq(t, Either{20}, Either{10}.Map(double))
+	eq(t, Either{40}, Either{10}.Map(double).Map(double))
+	eq(t, Either{10}, Either{10}.Map(nil))
+	eq(t, Either{testErr()}, Either{testErr()}.Map(failMapper(t)))
+
+	err := testErr()
+	eq(t, Either{err}, Either{10}.Map(func(interface{}) interface{} { panic(err) }))
+
+	val, outErr := Either{10}.Map(func(interface{}) interface{} { panic(err) }).Unwrap()
+	eq(t, nil, val)
+	eq(t, err, outErr)
+
+	// Type assertion failures in the mapper are caught as well.
+	_, outErr = Either{`str`}.Map(double).Unwrap()
+	_, isRuntime := outErr.(runtime.Error)
+	eq(t, true, isRuntime)
+}
+
+func Test_Either_Then(t *testing.T) {
+	next := func(val interface{}) Getter {
+		return GetterFunc(func() interface{} { return val.(int) + 1 })
+	}
+
+	eq(t, Either{11}, Either{10}.Then(next))
+	eq(t, Either{12}, Either{10}.Then(next).Then(next))
+	eq(t, Either{10}, Either{10}.Then(nil))
+	eq(t, Either{}, Either{10}.Then(func(interface{}) Getter { return nil }))
+	eq(t, Either{`val`}, Either{10}.Then(func(interface{}) Getter { return Either{`val`} }))
+}
+
+func Test_Either_Then_short_circuit(t *testing.T) {
+	fail := func(interface{}) Getter { return failGetter(t) }
+
+	eq(t, Either{testErr()}, Either{testErr()}.Then(fail))
+	eq(t, Either{testErr()}, Either{10}.Then(func(interface{}) Getter { return Either{testErr()} }).Then(fail))
+}
+
+func Test_Either_Then_panic(t *testing.T) {
+	err := testErr()
+	panicky := GetterFunc(func() interface{} { panic(err) })
+
+	eq(t, Either{err}, Either{10}.Then(func(interface{}) Getter { return panicky }))
+	eq(t, Either{err}, Either{10}.Then(func(interface{}) Getter { panic(err) }))
+
+	_, outErr := Either{10}.Then(func(interface{}) Getter { return panicky }).Unwrap()
+	eq(t, err, outErr)
+}
+
+func Test_Either_SetGetterErr(t *testing.T) {
+	conv := func(val interface{}) error { return fmt.Errorf(`wrapped: %v`, val) }
+	panicky := GetterFunc(func() interface{} { panic(`str`) })
+
+	var tar Either
+	tar.SetGetterErr(nil, conv)
+	eq(t, Either{}, tar)
+
+	tar.SetGetterErr(Either{`val`}, conv)
+	eq(t, Either{`val`}, tar)
+
+	// Error panics also go through the converter.
+	tar.SetGetterErr(Either{testErr()}, conv)
+	eq(t, Either{fmt.Errorf(`wrapped: %v`, testErr())}, tar)
+
+	tar.SetGetterErr(panicky, conv)
+	eq(t, Either{fmt.Errorf(`wrapped: str`)}, tar)
+	panics(t, fmt.Errorf(`wrapped: str`), func() { tar.Get() })
+
+	tar.SetGetterErr(panicky, nil)
+	eqPanicErr(t, `str`, tar[0])
+
+	tar.SetGetterErr(panicky, func(interface{}) error { return nil })
+	eqPanicErr(t, `str`, tar[0])
+}
+
 func Test_Timed_SetTimer_nil(t *testing.T) {
 	for _, val := range testVals {
 		for _, inst := range testTimes {
@@ -75,235 +210,2844 @@ func Test_Timed_SetTimer_non_nil(t *testing.T) {
 	}
 }
 
-func Test_NewMem(t *testing.T) {
+func Test_Timed_WithValue(t *testing.T) {
 	for _, val := range testVals {
 		for _, inst := range testTimes {
-			eq(t, &Mem{val: Timed{Either{val}, inst}}, NewMem(MakeTimed(val, inst)))
+			src := MakeTimed(`old`, inst)
+			eq(t, MakeTimed(val, inst), src.WithValue(val))
+			eq(t, MakeTimed(`old`, inst), src)
 		}
 	}
 }
 
-func Test_Mem_Get(t *testing.T) {
+func Test_Timed_WithTime(t *testing.T) {
 	for _, val := range testVals {
-		testGet(t, val, NewMem(MakeTimed(val, time.Time{})))
+		for _, inst := range testTimes {
+			src := MakeTimed(val, time.Now())
+			prev := src.Time
+			eq(t, MakeTimed(val, inst), src.WithTime(inst))
+			eq(t, MakeTimed(val, prev), src)
+		}
 	}
 }
 
-func Test_Mem_GetTimed(t *testing.T) {
+func Test_Timed_IsZero(t *testing.T) {
 	for _, val := range testVals {
 		for _, inst := range testTimes {
-			eq(t, Timed{Either{val}, inst}, NewMem(MakeTimed(val, inst)).GetTimed())
+			eq(t, val == nil && inst.IsZero(), MakeTimed(val, inst).IsZero())
 		}
 	}
 }
 
-func Test_Mem_SetTimed(t *testing.T) {
+func Test_Timed_HasValue(t *testing.T) {
 	for _, val := range testVals {
 		for _, inst := range testTimes {
-			var mem Mem
-			mem.SetTimed(Timed{Either{val}, inst})
-			eq(t, Timed{Either{val}, inst}, mem.GetTimed())
+			_, isErr := val.(error)
+			eq(t, val != nil && !isErr, MakeTimed(val, inst).HasValue())
 		}
 	}
 }
 
-func Test_Mem_Zero(t *testing.T) {
+func Test_Timed_Age(t *testing.T) {
+	now := time.Date(2, 3, 4, 5, 6, 7, 8, time.UTC)
+
 	for _, val := range testVals {
 		for _, inst := range testTimes {
-			mem := NewMem(MakeTimed(val, inst))
-			mem.Zero()
-			eq(t, Timed{}, mem.GetTimed())
+			exp := now.Sub(inst)
+			if inst.IsZero() {
+				exp = math.MaxInt64
+			}
+			eq(t, exp, MakeTimed(val, inst).Age(now))
 		}
 	}
+
+	eq(t, time.Duration(math.MaxInt64), Timed{}.Age(now))
+	eq(t, time.Hour, MakeTimed(nil, now.Add(-time.Hour)).Age(now))
+	eq(t, -time.Hour, MakeTimed(nil, now.Add(time.Hour)).Age(now))
 }
 
-func Test_Mem_Dedup_from_zero(t *testing.T) {
-	for _, getter := range testGetters {
-		for _, timer := range testTimers {
-			for _, expirer := range testExpirers {
-				var mem Mem
-				var expected Timed
+func Test_Timed_LastModified(t *testing.T) {
+	eq(t, ``, Timed{}.LastModified())
 
-				if IsExpired(expirer, mem.GetTimed()) {
-					expected.SetGetter(getter)
-					expected.SetTimer(timer)
-				}
+	inst := time.Date(2021, 2, 3, 4, 5, 6, 7, time.FixedZone(``, 3600))
+	eq(t, `Wed, 03 Feb 2021 03:05:06 GMT`, MakeTimed(nil, inst).LastModified())
+	eq(t, inst.UTC().Format(http.TimeFormat), MakeTimed(nil, inst).LastModified())
+}
 
-				actual := mem.Dedup(getter, timer, expirer)
+func Test_Timed_MaxAge(t *testing.T) {
+	now := time.Date(2021, 2, 3, 4, 5, 6, 7, time.UTC)
+	ttl := time.Minute
 
-				eq(t, actual, mem.GetTimed())
+	eq(t, 60, MakeTimed(nil, now).MaxAge(ttl, now))
+	eq(t, 30, MakeTimed(nil, now.Add(-time.Second*30)).MaxAge(ttl, now))
+	eq(t, 29, MakeTimed(nil, now.Add(-time.Second*30-time.Millisecond)).MaxAge(ttl, now))
+	eq(t, 0, MakeTimed(nil, now.Add(-ttl)).MaxAge(ttl, now))
+	eq(t, 0, MakeTimed(nil, now.Add(-time.Hour)).MaxAge(ttl, now))
+	eq(t, 0, Timed{}.MaxAge(ttl, now))
+	eq(t, 0, MakeTimed(nil, now).MaxAge(-ttl, now))
+}
 
-				if !reflect.DeepEqual(expected, actual) {
-					t.Fatalf(`
-getter:
-	%#[1]v
-timer:
-	%#[2]v
-expirer:
-	%#[3]v
-expected %[4]T (detailed):
-	%#[4]v
-actual %[5]T (detailed):
-	%#[5]v
-expected %[4]T (simple):
-	%[4]v
-actual %[5]T (simple):
-	%[5]v
-`, getter, timer, expirer, expected, actual)
+func Test_Timed_Equal(t *testing.T) {
+	for _, one := range testVals {
+		for _, two := range testVals {
+			for _, inst0 := range testTimes {
+				for _, inst1 := range testTimes {
+					eq(
+						t,
+						reflect.DeepEqual(one, two) && inst0.Equal(inst1),
+						MakeTimed(one, inst0).Equal(MakeTimed(two, inst1)),
+					)
 				}
 			}
 		}
 	}
+
+	inst := testTimes[1]
+	eq(t, true, MakeTimed([]int{1}, inst).Equal(MakeTimed([]int{1}, inst)))
+	eq(t, true, MakeTimed([]int{1}, inst).Equal(MakeTimed([]int{1}, inst.In(time.FixedZone(``, 3600)))))
+	eq(t, false, MakeTimed([]int{1}, inst).Equal(MakeTimed([]int{1}, inst.Add(time.Nanosecond))))
+	eq(t, false, MakeTimed([]int{1}, inst).Equal(MakeTimed([]int{2}, inst)))
 }
 
-func Test_Mem_Dedup_from_non_zero(t *testing.T) {
-	for _, getter0 := range testGetters {
-		for _, timer0 := range testTimers {
-			for _, expirer0 := range testExpirers {
-				for _, getter1 := range testGetters {
-					for _, timer1 := range testTimers {
-						for _, expirer1 := range testExpirers {
-							var mem Mem
-							mem.Dedup(getter0, timer0, expirer0)
+func Test_Timed_Copy(t *testing.T) {
+	for _, val := range testVals {
+		eq(t, MakeTimed(val, testTimes[1]), MakeTimed(val, testTimes[1]).Copy())
+	}
 
-							var expected Timed
+	type Nested struct{ Vals []int }
 
-							if IsExpired(expirer1, mem.GetTimed()) {
-								expected.SetGetter(getter1)
-								expected.SetTimer(timer1)
-							} else {
-								expected = mem.GetTimed()
-							}
+	src := MakeTimed(map[string]interface{}{
+		`slice`:  []int{10, 20},
+		`nested`: [][]string{{`one`}, {`two`}},
+		`map`:    map[int][]int{1: {10}},
+		`array`:  [1][]int{{10}},
+		`struct`: Nested{[]int{10}},
+		`nil`:    []int(nil),
+	}, testTimes[1])
 
-							actual := mem.Dedup(getter1, timer1, expirer1)
+	out := src.Copy()
+	eq(t, src, out)
 
-							eq(t, actual, mem.GetTimed())
+	val := out.Get().(map[string]interface{})
+	val[`slice`].([]int)[0] = 11
+	val[`nested`].([][]string)[0][0] = `three`
+	val[`map`].(map[int][]int)[1][0] = 11
+	val[`array`].([1][]int)[0][0] = 11
+	val[`struct`].(Nested).Vals[0] = 11
+	val[`added`] = true
 
-							if !reflect.DeepEqual(expected, actual) {
-								t.Fatalf(`
-getter0:
-	%#[1]v
-timer0:
-	%#[2]v
-expirer0:
-	%#[3]v
-getter1:
-	%#[4]v
-timer1:
-	%#[5]v
-expirer1:
-	%#[6]v
-expected %[7]T (detailed):
-	%#[7]v
-actual %[8]T (detailed):
-	%#[8]v
-expected %[7]T (simple):
-	%[7]v
-actual %[8]T (simple):
-	%[8]v
-`, getter0, timer0, expirer0, getter1, timer1, expirer1, expected, actual)
-							}
-						}
-					}
-				}
-			}
+	eq(
+		t,
+		MakeTimed(map[string]interface{}{
+			`slice`:  []int{10, 20},
+			`nested`: [][]string{{`one`}, {`two`}},
+			`map`:    map[int][]int{1: {10}},
+			`array`:  [1][]int{{10}},
+			// Struct fields are shared.
+			`struct`: Nested{[]int{11}},
+			`nil`:    []int(nil),
+		}, testTimes[1]),
+		src,
+	)
+}
+
+func Test_Timed_Err(t *testing.T) {
+	for _, val := range testVals {
+		for _, inst := range testTimes {
+			err, _ := val.(error)
+			eq(t, err, MakeTimed(val, inst).Err())
 		}
 	}
 }
 
-func Test_Mem_Dedup_not_expired_no_unnecessary_calls(t *testing.T) {
-	for _, getter := range []Getter{nil, failGetter(t)} {
-		for _, timer := range []Timer{nil, failTimer(t)} {
-			new(Mem).Dedup(getter, timer, BoolExpirer(false))
+func Test_Timed_String(t *testing.T) {
+	eq(t, `<nil>`, Timed{}.String())
+	eq(t, `10`, MakeTimed(10, testTimes[1]).String())
+	eq(t, `str`, MakeTimed(`str`, testTimes[1]).String())
+	eq(t, testErr().Error(), MakeTimed(testErr(), testTimes[1]).String())
+	eq(t, testErr().Error(), fmt.Sprint(MakeTimed(testErr(), testTimes[1])))
+}
+
+func Test_NewMem(t *testing.T) {
+	for _, val := range testVals {
+		for _, inst := range testTimes {
+			eq(t, Timed{Either{val}, inst}, NewMem(MakeTimed(val, inst)).GetTimed())
 		}
 	}
 }
 
-func Test_Mem_Dedup_concurrent_reading(t *testing.T) {
-	timed := MakeTimed(`some value`, time.Time{})
-	mem := NewMem(timed)
-	mem.lock.RLock()
+func Test_Mem_Get(t *testing.T) {
+	for _, val := range testVals {
+		testGet(t, val, NewMem(MakeTimed(val, time.Time{})))
+	}
+}
 
-	const count = 8
-	var expected []Timed
-	actual := make([]Timed, count)
+func Test_Mem_GetCopy(t *testing.T) {
+	mem := NewMem(MakeTimed([]int{10, 20}, testTimes[1]))
 
-	var wg sync.WaitGroup
-	for i := range counter(count) {
-		wg.Add(1)
+	val := mem.GetCopy().([]int)
+	val[0] = 30
+	eq(t, []int{30, 20}, val)
+	eq(t, []int{10, 20}, mem.Get())
 
-		go func(index int) {
-			defer wg.Add(-1)
-			actual[index] = mem.Dedup(failGetter(t), failTimer(t), BoolExpirer(false))
-		}(i)
+	err := testErr()
+	mem.SetTimed(MakeTimed(err, testTimes[1]))
+	panics(t, err, func() { mem.GetCopy() })
+}
 
-		expected = append(expected, timed)
+func Test_Mem_GetErr(t *testing.T) {
+	test := func(mem *Mem, expVal interface{}, expErr error) {
+		t.Helper()
+		val, err := mem.GetErr()
+		eq(t, expVal, val)
+		eq(t, expErr, err)
 	}
 
-	wg.Wait()
+	test(new(Mem), nil, nil)
+	test(NewMem(MakeTimed(10, time.Time{})), 10, nil)
+	test(NewMem(MakeTimed(`val`, testTimes[1])), `val`, nil)
 
-	eq(t, count, len(expected))
-	eq(t, count, len(actual))
-	eq(t, expected, actual)
+	err := testErr()
+	test(NewMem(MakeTimed(err, testTimes[1])), nil, err)
 }
 
-func Test_Mem_Dedup_waiting_for_writer(t *testing.T) {
-	oldTimed := MakeTimed(`old value`, time.Date(1, 2, 3, 4, 5, 6, 7, time.UTC))
-	newTimed := MakeTimed(`new value`, time.Date(2, 3, 4, 5, 6, 7, 8, time.UTC))
-	mem := NewMem(oldTimed)
-	getter := newSlowGetter(newTimed.Get())
-	timer := Inst(newTimed.Time)
-	writerDone := make(chan struct{})
-	readerDone := make(chan struct{})
+func Test_Mem_GetTimed(t *testing.T) {
+	for _, val := range testVals {
+		for _, inst := range testTimes {
+			eq(t, Timed{Either{val}, inst}, NewMem(MakeTimed(val, inst)).GetTimed())
+		}
+	}
+}
 
-	go func() {
-		defer close(writerDone)
-		mem.Dedup(getter, timer, BoolExpirer(true))
-	}()
+func Test_Mem_GetTimedOr(t *testing.T) {
+	fallback := MakeTimed(`fallback`, testTimes[1])
+	eq(t, fallback, new(Mem).GetTimedOr(fallback))
 
-	/**
-	What we actually want is to wait precisely until the goroutine above acquires
-	the write lock. Unfortunately I'm not aware how to do that with Go mutexes,
-	which lack "try lock" functionality. Hence this fragile workaround.
-	*/
-	time.Sleep(time.Millisecond)
+	for _, val := range testVals {
+		for _, inst := range testTimes {
+			timed := MakeTimed(val, inst)
+			if val == nil && inst.IsZero() {
+				eq(t, fallback, NewMem(timed).GetTimedOr(fallback))
+			} else {
+				eq(t, timed, NewMem(timed).GetTimedOr(fallback))
+			}
+		}
+	}
+}
 
-	eq(t, false, isDone(writerDone))
+func Test_Mem_TryGetTimed(t *testing.T) {
+	timed := MakeTimed(10, testTimes[1])
+	mem := NewMem(timed)
 
-	/**
-	As a side effect of the current implementation, a currenly-active writer will
-	block even those readers which consider the current value to be non-expired.
-	This is unfortunate, but fixing this invites surprising complexity and
-	gotchas. Maybe later.
-	*/
-	go func() {
-		defer close(readerDone)
-		eq(t, newTimed, mem.Dedup(failGetter(t), failTimer(t), BoolExpirer(false)))
-	}()
+	val, ok := mem.TryGetTimed()
+	eq(t, timed, val)
+	eq(t, true, ok)
 
-	// Same workaround as above: wait until the reader is blocked.
-	time.Sleep(time.Millisecond)
+	// Reads don't wait for writers.
+	mem.lock.Lock()
+	val, ok = mem.TryGetTimed()
+	mem.lock.Unlock()
+	eq(t, timed, val)
+	eq(t, true, ok)
+}
 
-	eq(t, false, isDone(readerDone))
+func Test_Mem_Peek(t *testing.T) {
+	test := func(mem *Mem, exp Expirer, expVal Timed, expExpired bool) {
+		t.Helper()
+		val, expired := mem.Peek(exp)
+		eq(t, expVal, val)
+		eq(t, expExpired, expired)
+	}
 
-	// Unblock both. The reader contains the assertion verifying the new value.
-	getter.Done()
-	eq(t, struct{}{}, <-writerDone)
-	eq(t, struct{}{}, <-readerDone)
+	test(new(Mem), nil, Timed{}, true)
+	test(new(Mem), Duration(time.Hour), Timed{}, true)
+
+	fresh := MakeTimed(10, time.Now())
+	test(NewMem(fresh), Duration(time.Hour), fresh, false)
+	test(NewMem(fresh), BoolExpirer(true), fresh, true)
+
+	failed := MakeTimed(testErr(), time.Now())
+	test(NewMem(failed), Duration(time.Hour), failed, false)
 }
 
-func Benchmark_Mem_refresh(b *testing.B) {
-	mem := new(Mem)
-	b.ResetTimer()
-	for range counter(b.N) {
-		benchMemRefresh(mem)
+func Test_Mem_Age(t *testing.T) {
+	eq(t, time.Duration(math.MaxInt64), new(Mem).Age())
+
+	age := NewMem(MakeTimed(nil, time.Now().Add(-time.Hour))).Age()
+	eq(t, true, age >= time.Hour && age < time.Hour+time.Minute)
+}
+
+func Test_Mem_Expired(t *testing.T) {
+	for _, val := range testVals {
+		for _, inst := range testTimes {
+			for _, expirer := range testExpirers {
+				timed := MakeTimed(val, inst)
+				eq(t, IsExpired(expirer, timed), NewMem(timed).Expired(expirer))
+			}
+		}
 	}
+
+	eq(t, true, new(Mem).Expired(nil))
+	eq(t, true, new(Mem).Expired(BoolExpirer(true)))
+	eq(t, false, new(Mem).Expired(BoolExpirer(false)))
+	eq(t, false, NewMem(MakeTimed(10, time.Now())).Expired(Duration(time.Hour)))
+	eq(t, true, NewMem(MakeTimed(10, testTimes[1])).Expired(Duration(time.Hour)))
 }
 
-//go:noinline
-func benchMemRefresh(mem *Mem) {
-	// Should regenerate the value every time, using a write lock.
-	// All these interface conversions should be zero-alloc.
-	// The benchmark should show zero allocs.
-	mem.Dedup(GetterFunc(staticGetter), Void{}, BoolExpirer(true))
+func Test_Mem_DedupReadOnly(t *testing.T) {
+	test := func(mem *Mem, exp Expirer, expVal Timed, expFresh bool) {
+		t.Helper()
+		val, fresh := mem.DedupReadOnly(exp)
+		eq(t, expVal, val)
+		eq(t, expFresh, fresh)
+		eq(t, expVal, mem.GetTimed())
+		eq(t, uint64(0), mem.Generation())
+	}
+
+	test(new(Mem), nil, Timed{}, false)
+	test(new(Mem), IsZeroExpirer{}, Timed{}, false)
+
+	timed := MakeTimed(10, testTimes[1])
+	test(NewMem(timed), BoolExpirer(false), timed, true)
+	test(NewMem(timed), BoolExpirer(true), timed, false)
+	test(NewMem(timed), nil, timed, false)
 }
+
+func Test_Mem_SetTimed(t *testing.T) {
+	for _, val := range testVals {
+		for _, inst := range testTimes {
+			var mem Mem
+			mem.SetTimed(Timed{Either{val}, inst})
+			eq(t, Timed{Either{val}, inst}, mem.GetTimed())
+		}
+	}
+}
+
+func Test_Mem_Load_Store(t *testing.T) {
+	for _, val := range testVals {
+		for _, inst := range testTimes {
+			var mem Mem
+			mem.Store(MakeTimed(val, inst))
+			eq(t, MakeTimed(val, inst), mem.Load())
+			eq(t, mem.GetTimed(), mem.Load())
+		}
+	}
+}
+
+func Test_Mem_Swap(t *testing.T) {
+	var mem Mem
+	eq(t, Timed{}, mem.Swap(MakeTimed(10, testTimes[1])))
+	eq(t, MakeTimed(10, testTimes[1]), mem.Swap(MakeTimed(20, time.Time{})))
+	eq(t, MakeTimed(20, time.Time{}), mem.GetTimed())
+}
+
+func Test_Mem_Swap_concurrent(t *testing.T) {
+	var mem Mem
+	const count = 64
+	out := make(chan Timed, count)
+
+	var wg sync.WaitGroup
+	for i := range counter(count) {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Add(-1)
+			out <- mem.Swap(MakeTimed(i, time.Time{}))
+		}(i + 1)
+	}
+	wg.Wait()
+	close(out)
+
+	// Every stored value is returned exactly once: either by a later swap, or
+	// by the final read.
+	seen := map[interface{}]int{}
+	for val := range out {
+		seen[val.Either[0]]++
+	}
+	seen[mem.GetTimed().Either[0]]++
+
+	eq(t, count+1, len(seen))
+	for _, num := range seen {
+		eq(t, 1, num)
+	}
+}
+
+func Test_Mem_CompareAndSwapTimed(t *testing.T) {
+	mem := NewMem(MakeTimed([]int{10}, testTimes[1]))
+
+	eq(t, false, mem.CompareAndSwapTimed(MakeTimed([]int{20}, testTimes[1]), MakeTimed(30, time.Time{})))
+	eq(t, false, mem.CompareAndSwapTimed(MakeTimed([]int{10}, time.Time{}), MakeTimed(30, time.Time{})))
+	eq(t, false, mem.CompareAndSwapTimed(MakeTimed([]int64{10}, testTimes[1]), MakeTimed(30, time.Time{})))
+	eq(t, MakeTimed([]int{10}, testTimes[1]), mem.GetTimed())
+	eq(t, uint64(0), mem.Generation())
+
+	eq(t, true, mem.CompareAndSwapTimed(MakeTimed([]int{10}, testTimes[1]), MakeTimed(30, time.Time{})))
+	eq(t, MakeTimed(30, time.Time{}), mem.GetTimed())
+	eq(t, uint64(1), mem.Generation())
+
+	var zero Mem
+	eq(t, true, zero.CompareAndSwapTimed(Timed{}, MakeTimed(10, time.Time{})))
+	eq(t, false, zero.CompareAndSwapTimed(Timed{}, MakeTimed(20, time.Time{})))
+}
+
+func Test_Mem_CompareAndSwapTimed_concurrent(t *testing.T) {
+	mem := NewMem(MakeTimed(0, time.Time{}))
+	const count = 16
+	const incs = 100
+
+	var wg sync.WaitGroup
+	for range counter(count) {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			for range counter(incs) {
+				for {
+					prev := mem.GetTimed()
+					next := MakeTimed(prev.Get().(int)+1, time.Time{})
+					if mem.CompareAndSwapTimed(prev, next) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	eq(t, MakeTimed(count*incs, time.Time{}), mem.GetTimed())
+	eq(t, uint64(count*incs), mem.Generation())
+}
+
+func Test_Mem_SetIfExpired(t *testing.T) {
+	prev := MakeTimed(10, testTimes[1])
+	next := MakeTimed(20, time.Time{})
+
+	mem := NewMem(prev)
+	val, ok := mem.SetIfExpired(next, BoolExpirer(false))
+	eq(t, prev, val)
+	eq(t, false, ok)
+	eq(t, prev, mem.GetTimed())
+
+	val, ok = mem.SetIfExpired(next, BoolExpirer(true))
+	eq(t, next, val)
+	eq(t, true, ok)
+	eq(t, next, mem.GetTimed())
+
+	val, ok = new(Mem).SetIfExpired(next, nil)
+	eq(t, next, val)
+	eq(t, true, ok)
+}
+
+func Test_Mem_Invalidate(t *testing.T) {
+	fresh := MakeTimed(10, time.Now())
+	stale := MakeTimed(20, time.Now().Add(-time.Hour))
+
+	mem := NewMem(fresh)
+	eq(t, false, mem.Invalidate(Duration(time.Minute)))
+	eq(t, fresh, mem.GetTimed())
+
+	mem = NewMem(stale)
+	eq(t, true, mem.Invalidate(Duration(time.Minute)))
+	eq(t, Timed{}, mem.GetTimed())
+
+	mem = NewMem(fresh)
+	eq(t, true, mem.Invalidate(BoolExpirer(true)))
+	eq(t, Timed{}, mem.GetTimed())
+
+	mem = NewMem(fresh)
+	eq(t, true, mem.Invalidate(nil))
+	eq(t, Timed{}, mem.GetTimed())
+}
+
+func Test_Mem_Clone(t *testing.T) {
+	one := MakeTimed(10, testTimes[1])
+	two := MakeTimed(20, time.Time{})
+	three := MakeTimed(30, time.Time{})
+
+	src := NewMem(one)
+	out := src.Clone()
+	eq(t, one, out.GetTimed())
+
+	out.SetTimed(two)
+	eq(t, one, src.GetTimed())
+	eq(t, two, out.GetTimed())
+
+	src.SetTimed(three)
+	eq(t, three, src.GetTimed())
+	eq(t, two, out.GetTimed())
+}
+
+func Test_Mem_Zero(t *testing.T) {
+	for _, val := range testVals {
+		for _, inst := range testTimes {
+			mem := NewMem(MakeTimed(val, inst))
+			mem.Zero()
+			eq(t, Timed{}, mem.GetTimed())
+		}
+	}
+}
+
+func Test_Mem_SetListener(t *testing.T) {
+	type pair struct{ prev, next Timed }
+	var pairs []pair
+	var mem Mem
+
+	mem.SetListener(func(prev, next Timed) {
+		// Invoked outside the lock, so reading doesn't deadlock.
+		eq(t, next, mem.GetTimed())
+		pairs = append(pairs, pair{prev, next})
+	})
+
+	one := MakeTimed(10, testTimes[1])
+	two := MakeTimed(20, time.Time{})
+
+	mem.SetTimed(one)
+	mem.Dedup(failGetter(t), failTimer(t), BoolExpirer(false))
+	mem.Dedup(Either{20}, Void{}, BoolExpirer(true))
+	mem.Zero()
+
+	eq(t, []pair{{Timed{}, one}, {one, two}, {two, Timed{}}}, pairs)
+
+	mem.SetListener(nil)
+	mem.SetTimed(one)
+	eq(t, 3, len(pairs))
+	eq(t, (*memTransition)(nil), mem.pend)
+}
+
+func Test_Mem_Subscribe(t *testing.T) {
+	var mem Mem
+	one, unsubOne := mem.Subscribe()
+	two, unsubTwo := mem.Subscribe()
+
+	eq(t, 0, len(one))
+	eq(t, 0, len(two))
+
+	first := MakeTimed(10, testTimes[1])
+	second := MakeTimed(20, time.Time{})
+
+	mem.SetTimed(first)
+	eq(t, first, <-one)
+	eq(t, first, <-two)
+
+	// Fresh values are not rewritten, and not delivered.
+	mem.Dedup(failGetter(t), failTimer(t), BoolExpirer(false))
+	eq(t, 0, len(one))
+
+	mem.Dedup(Either{20}, Void{}, BoolExpirer(true))
+	eq(t, second, <-one)
+	eq(t, second, <-two)
+
+	// Slow subscribers get the latest state.
+	mem.SetTimed(first)
+	mem.SetTimed(second)
+	mem.Zero()
+	eq(t, Timed{}, <-one)
+	eq(t, 0, len(one))
+
+	unsubOne()
+	unsubOne()
+	eq(t, 1, len(mem.subs))
+
+	val, ok := <-one
+	eq(t, Timed{}, val)
+	eq(t, false, ok)
+
+	mem.SetTimed(first)
+	eq(t, first, <-two)
+
+	unsubTwo()
+	eq(t, 0, len(mem.subs))
+
+	_, ok = <-two
+	eq(t, false, ok)
+
+	// Writes after unsubscribing don't panic on closed channels.
+	mem.SetTimed(second)
+}
+
+func Test_Mem_Subscribe_slow_subscriber(t *testing.T) {
+	var mem Mem
+	out, unsub := mem.Subscribe()
+	defer unsub()
+
+	const count = 64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range counter(count) {
+			mem.SetTimed(MakeTimed(i, time.Time{}))
+		}
+	}()
+
+	// Writers are never blocked by a subscriber that doesn't read.
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal(`expected writers to not block on subscribers`)
+	}
+
+	eq(t, MakeTimed(count-1, time.Time{}), <-out)
+}
+
+func Test_Mem_Subscribe_concurrent(t *testing.T) {
+	var mem Mem
+	out, unsub := mem.Subscribe()
+
+	const count = 64
+	received := make(chan int)
+	go func() {
+		var last int
+		for val := range out {
+			next := val.Get().(int)
+			// Coalescing may skip states, but never reorders them.
+			eq(t, true, next > last)
+			last = next
+		}
+		received <- last
+	}()
+
+	for i := range counter(count) {
+		mem.SetTimed(MakeTimed(i+1, time.Time{}))
+	}
+
+	// The last pending state remains receivable after closing.
+	unsub()
+	eq(t, count, <-received)
+}
+
+func Test_Mem_Generation(t *testing.T) {
+	var mem Mem
+	eq(t, uint64(0), mem.Generation())
+
+	mem.SetTimed(MakeTimed(10, testTimes[1]))
+	eq(t, uint64(1), mem.Generation())
+
+	mem.Dedup(failGetter(t), failTimer(t), BoolExpirer(false))
+	eq(t, uint64(1), mem.Generation())
+
+	mem.Dedup(Either{20}, Void{}, BoolExpirer(true))
+	eq(t, uint64(2), mem.Generation())
+
+	mem.Zero()
+	eq(t, uint64(3), mem.Generation())
+}
+
+/*
+On 32-bit platforms, 64-bit atomic operations panic on fields that aren't
+64-bit aligned, which happens when `Mem` is embedded after a smaller field.
+Meaningful only when testing with GOARCH=386 or similar.
+*/
+func Test_Mem_Generation_embedded(t *testing.T) {
+	var tar struct {
+		_ bool
+		Mem
+	}
+
+	tar.Dedup(Either{10}, nil, nil)
+	eq(t, uint64(1), tar.Generation())
+}
+
+func Test_Mem_Generation_concurrent(t *testing.T) {
+	var mem Mem
+	getter := newSlowGetter(`val`)
+
+	var wg sync.WaitGroup
+	for range counter(8) {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			mem.Dedup(getter, Void{}, IsZeroExpirer{})
+		}()
+	}
+
+	<-getter.Entered()
+	getter.Done()
+	wg.Wait()
+
+	eq(t, uint64(1), mem.Generation())
+
+	for range counter(8) {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			mem.Dedup(Either{`val`}, Void{}, BoolExpirer(true))
+		}()
+	}
+	wg.Wait()
+
+	eq(t, uint64(9), mem.Generation())
+}
+
+func Test_Mem_Dedup_from_zero(t *testing.T) {
+	for _, getter := range testGetters {
+		for _, timer := range testTimers {
+			for _, expirer := range testExpirers {
+				var mem Mem
+				var expected Timed
+
+				if IsExpired(expirer, mem.GetTimed()) {
+					expected.SetGetter(getter)
+					expected.SetTimer(timer)
+				}
+
+				actual := mem.Dedup(getter, timer, expirer)
+
+				eq(t, actual, mem.GetTimed())
+
+				if !reflect.DeepEqual(expected, actual) {
+					t.Fatalf(`
+getter:
+	%#[1]v
+timer:
+	%#[2]v
+expirer:
+	%#[3]v
+expected %[4]T (detailed):
+	%#[4]v
+actual %[5]T (detailed):
+	%#[5]v
+expected %[4]T (simple):
+	%[4]v
+actual %[5]T (simple):
+	%[5]v
+`, getter, timer, expirer, expected, actual)
+				}
+			}
+		}
+	}
+}
+
+func Test_Mem_Dedup_from_non_zero(t *testing.T) {
+	for _, getter0 := range testGetters {
+		for _, timer0 := range testTimers {
+			for _, expirer0 := range testExpirers {
+				for _, getter1 := range testGetters {
+					for _, timer1 := range testTimers {
+						for _, expirer1 := range testExpirers {
+							var mem Mem
+							mem.Dedup(getter0, timer0, expirer0)
+
+							var expected Timed
+
+							if IsExpired(expirer1, mem.GetTimed()) {
+								expected.SetGetter(getter1)
+								expected.SetTimer(timer1)
+							} else {
+								expected = mem.GetTimed()
+							}
+
+							actual := mem.Dedup(getter1, timer1, expirer1)
+
+							eq(t, actual, mem.GetTimed())
+
+							if !reflect.DeepEqual(expected, actual) {
+								t.Fatalf(`
+getter0:
+	%#[1]v
+timer0:
+	%#[2]v
+expirer0:
+	%#[3]v
+getter1:
+	%#[4]v
+timer1:
+	%#[5]v
+expirer1:
+	%#[6]v
+expected %[7]T (detailed):
+	%#[7]v
+actual %[8]T (detailed):
+	%#[8]v
+expected %[7]T (simple):
+	%[7]v
+actual %[8]T (simple):
+	%[8]v
+`, getter0, timer0, expirer0, getter1, timer1, expirer1, expected, actual)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func Test_Mem_Dedup_not_expired_no_unnecessary_calls(t *testing.T) {
+	for _, getter := range []Getter{nil, failGetter(t)} {
+		for _, timer := range []Timer{nil, failTimer(t)} {
+			new(Mem).Dedup(getter, timer, BoolExpirer(false))
+		}
+	}
+}
+
+func Test_Mem_Dedup_concurrent_reading(t *testing.T) {
+	timed := MakeTimed(`some value`, time.Time{})
+	mem := NewMem(timed)
+
+	// Fresh readers don't touch the write lock.
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+
+	const count = 8
+	var expected []Timed
+	actual := make([]Timed, count)
+
+	var wg sync.WaitGroup
+	for i := range counter(count) {
+		wg.Add(1)
+
+		go func(index int) {
+			defer wg.Add(-1)
+			actual[index] = mem.Dedup(failGetter(t), failTimer(t), BoolExpirer(false))
+		}(i)
+
+		expected = append(expected, timed)
+	}
+
+	wg.Wait()
+
+	eq(t, count, len(expected))
+	eq(t, count, len(actual))
+	eq(t, expected, actual)
+}
+
+func Test_Mem_Dedup_waiting_for_writer(t *testing.T) {
+	oldTimed := MakeTimed(`old value`, time.Date(1, 2, 3, 4, 5, 6, 7, time.UTC))
+	newTimed := MakeTimed(`new value`, time.Date(2, 3, 4, 5, 6, 7, 8, time.UTC))
+	mem := NewMem(oldTimed)
+	getter := newSlowGetter(newTimed.Get())
+	timer := Inst(newTimed.Time)
+	writerDone := make(chan struct{})
+	readerDone := make(chan struct{})
+
+	go func() {
+		defer close(writerDone)
+		mem.Dedup(getter, timer, BoolExpirer(true))
+	}()
+
+	// The writer holds the write lock while it's inside the getter.
+	<-getter.Entered()
+	eq(t, false, isDone(writerDone))
+
+	// Readers which consider the current value to be non-expired don't wait for
+	// the active writer, and get the old value.
+	eq(t, oldTimed, mem.Dedup(failGetter(t), failTimer(t), BoolExpirer(false)))
+	eq(t, oldTimed, mem.GetTimed())
+
+	// Readers which consider the current value to be expired wait for the
+	// writer, and reuse its value.
+	go func() {
+		defer close(readerDone)
+		eq(t, newTimed, mem.Dedup(failGetter(t), failTimer(t), ExpirerNot{Inst(oldTimed.Time)}))
+	}()
+
+	/**
+	Give the reader a chance to block on the write lock. There's no way to wait
+	for that precisely. Either way, the reader can't finish yet: the writer is
+	still inside the getter, holding the lock, and hasn't published the new
+	value, which the reader waits for.
+	*/
+	time.Sleep(time.Millisecond)
+
+	eq(t, false, isDone(readerDone))
+
+	// Unblock both. The reader contains the assertion verifying the new value.
+	getter.Done()
+	eq(t, struct{}{}, <-writerDone)
+	eq(t, struct{}{}, <-readerDone)
+}
+
+func Test_Mem_Dedup_readers_during_regeneration(t *testing.T) {
+	oldTimed := MakeTimed(`old value`, testTimes[1])
+	newTimed := MakeTimed(`new value`, time.Date(2, 3, 4, 5, 6, 7, 8, time.UTC))
+	mem := NewMem(oldTimed)
+	slow := newSlowGetter(newTimed.Get())
+	expired := ExpirerNot{Inst(oldTimed.Time)}
+
+	var calls int64
+	getter := GetterFunc(func() interface{} {
+		atomic.AddInt64(&calls, 1)
+		return slow.Get()
+	})
+
+	const count = 8
+	var wg sync.WaitGroup
+	for range counter(count) {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			eq(t, newTimed, mem.Dedup(getter, Inst(newTimed.Time), expired))
+		}()
+	}
+
+	// One of the writers is inside the getter, holding the write lock.
+	<-slow.Entered()
+
+	// While the getter runs, fresh readers get the old value without waiting.
+	// If they waited, this would deadlock.
+	for range counter(count) {
+		eq(t, oldTimed, mem.Dedup(failGetter(t), failTimer(t), BoolExpirer(false)))
+		eq(t, oldTimed, mem.GetTimed())
+	}
+
+	slow.Done()
+	wg.Wait()
+
+	// Writers were coalesced.
+	eq(t, int64(1), calls)
+	eq(t, newTimed, mem.GetTimed())
+}
+
+func Test_Mem_Dedup_reentrant(t *testing.T) {
+	// Embedded after a smaller field, to check the alignment of atomic ops on
+	// 32-bit platforms.
+	var tar struct {
+		_ bool
+		Mem
+	}
+	mem := &tar.Mem
+	var other Mem
+	mem.SetDetectReentrancy(true)
+
+	getter := GetterFunc(func() interface{} {
+		// Reads don't wait for the lock, and observe the previous state.
+		eq(t, nil, mem.Get())
+
+		panics(t, ErrReentrant, func() { mem.Dedup(failGetter(t), failTimer(t), nil) })
+		panics(t, ErrReentrant, func() { mem.Zero() })
+
+		// Other instances are unaffected.
+		return other.Dedup(Either{10}, nil, nil).Get()
+	})
+	eq(t, MakeTimed(10, testTimes[1]), mem.Dedup(getter, Inst(testTimes[1]), nil))
+
+	// Unrecovered, the panic is stored as the result of the outer call.
+	getter = GetterFunc(func() interface{} { return mem.Dedup(nil, nil, nil) })
+	eq(t, MakeTimed(ErrReentrant, testTimes[1]), mem.Dedup(getter, Inst(testTimes[1]), nil))
+
+	timer := TimerFunc(func() time.Time { return mem.Refresh(nil, nil).Time })
+	// Timer panics don't affect the timestamp.
+	eq(t, MakeTimed(ErrReentrant, testTimes[1]), mem.Dedup(Either{20}, timer, nil))
+
+	// The writer is cleared after regeneration.
+	eq(t, MakeTimed(30, time.Time{}), mem.Dedup(Either{30}, nil, nil))
+	eq(t, MakeTimed(30, time.Time{}), mem.GetTimed())
+}
+
+func Test_Mem_Refresh(t *testing.T) {
+	var calls int
+	getter := GetterFunc(func() interface{} {
+		calls++
+		return calls
+	})
+
+	mem := NewMem(MakeTimed(`fresh`, time.Now()))
+
+	eq(t, MakeTimed(1, testTimes[1]), mem.Refresh(getter, Inst(testTimes[1])))
+	eq(t, MakeTimed(1, testTimes[1]), mem.GetTimed())
+
+	eq(t, MakeTimed(2, time.Time{}), mem.Refresh(getter, nil))
+	eq(t, MakeTimed(2, time.Time{}), mem.GetTimed())
+	eq(t, 2, calls)
+}
+
+func Test_Mem_Replace(t *testing.T) {
+	var mem Mem
+
+	prev, next := mem.Replace(Either{10}, Inst(testTimes[1]))
+	eq(t, Timed{}, prev)
+	eq(t, MakeTimed(10, testTimes[1]), next)
+	eq(t, next, mem.GetTimed())
+
+	prev, next = mem.Replace(Either{20}, nil)
+	eq(t, MakeTimed(10, testTimes[1]), prev)
+	eq(t, MakeTimed(20, time.Time{}), next)
+	eq(t, next, mem.GetTimed())
+}
+
+func Test_Mem_Replace_concurrent(t *testing.T) {
+	var mem Mem
+	var calls int64
+	const count = 64
+	getter := GetterFunc(func() interface{} { return atomic.AddInt64(&calls, 1) })
+	out := make(chan [2]Timed, count)
+
+	var wg sync.WaitGroup
+	for range counter(count) {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			prev, next := mem.Replace(getter, nil)
+			out <- [2]Timed{prev, next}
+		}()
+	}
+	wg.Wait()
+	close(out)
+
+	// Each state is replaced exactly once, forming a single chain.
+	prevs := map[interface{}]bool{}
+	for pair := range out {
+		eq(t, false, prevs[pair[0].Either[0]])
+		prevs[pair[0].Either[0]] = true
+		eq(t, pair[0].Get() == nil, pair[1].Get() == int64(1))
+	}
+	eq(t, count, len(prevs))
+}
+
+func Test_Mem_StartRefresher(t *testing.T) {
+	var mem Mem
+	var calls int64
+	getter := GetterFunc(func() interface{} { return atomic.AddInt64(&calls, 1) })
+
+	stop := mem.StartRefresher(time.Millisecond, getter, Inst(testTimes[1]))
+	defer stop()
+
+	deadline := time.Now().Add(time.Second)
+	for mem.Generation() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	stop()
+	stop()
+
+	total := atomic.LoadInt64(&calls)
+	eq(t, true, total >= 3)
+	eq(t, MakeTimed(total, testTimes[1]), mem.GetTimed())
+
+	// No refreshes after stopping.
+	time.Sleep(time.Millisecond * 5)
+	eq(t, total, atomic.LoadInt64(&calls))
+}
+
+func Test_Mem_StartRefresher_first_interval(t *testing.T) {
+	var mem Mem
+	stop := mem.StartRefresher(time.Hour, failGetter(t), failTimer(t))
+	stop()
+
+	// The first refresh waits for the first interval.
+	eq(t, Timed{}, mem.GetTimed())
+}
+
+func Test_Mem_StartRefresher_err(t *testing.T) {
+	mem := NewMem(MakeTimed(`old value`, time.Time{}))
+	stop := mem.StartRefresher(time.Millisecond, Either{testErr()}, nil)
+	defer stop()
+
+	deadline := time.Now().Add(time.Second)
+	for mem.Generation() < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+
+	eq(t, MakeTimed(testErr(), time.Time{}), mem.GetTimed())
+}
+
+func Test_Mem_StartRefresher_invalid_interval(t *testing.T) {
+	panics(t, `non-positive interval for NewTicker`, func() { new(Mem).StartRefresher(0, nil, nil) })
+}
+
+func Test_Mem_DedupAsync(t *testing.T) {
+	var mem Mem
+	timed := MakeTimed(10, testTimes[1])
+
+	out := mem.DedupAsync(Either{10}, Inst(testTimes[1]), nil)
+	eq(t, timed, <-out)
+	eq(t, Timed{}, <-out)
+	eq(t, timed, mem.GetTimed())
+
+	out = mem.DedupAsync(failGetter(t), failTimer(t), BoolExpirer(false))
+	eq(t, 1, len(out))
+	eq(t, mem.Dedup(failGetter(t), failTimer(t), BoolExpirer(false)), <-out)
+}
+
+func Test_Mem_DedupAsync_slow(t *testing.T) {
+	var mem Mem
+	getter := newSlowGetter(`val`)
+
+	out := mem.DedupAsync(getter, Void{}, nil)
+	eq(t, 0, len(out))
+
+	getter.Done()
+	eq(t, MakeTimed(`val`, time.Time{}), <-out)
+	eq(t, MakeTimed(`val`, time.Time{}), mem.GetTimed())
+}
+
+func Test_Mem_DedupNonBlockingFresh(t *testing.T) {
+	var mem Mem
+	timed := MakeTimed(10, testTimes[1])
+
+	eq(t, timed, mem.DedupNonBlockingFresh(Either{10}, Inst(testTimes[1]), nil))
+	eq(t, timed, mem.DedupNonBlockingFresh(failGetter(t), failTimer(t), BoolExpirer(false)))
+	eq(t, timed, NewMem(timed).DedupNonBlockingFresh(failGetter(t), failTimer(t), BoolExpirer(false)))
+}
+
+func Test_Mem_DedupNonBlockingFresh_during_write(t *testing.T) {
+	oldTimed := MakeTimed(`old value`, testTimes[1])
+	newTimed := MakeTimed(`new value`, time.Date(2, 3, 4, 5, 6, 7, 8, time.UTC))
+	mem := NewMem(oldTimed)
+	getter := newSlowGetter(newTimed.Get())
+	writerDone := make(chan struct{})
+	readerDone := make(chan struct{})
+
+	go func() {
+		defer close(writerDone)
+		mem.Dedup(getter, Inst(newTimed.Time), BoolExpirer(true))
+	}()
+
+	// The writer holds the write lock while it's inside the getter.
+	<-getter.Entered()
+	eq(t, false, isDone(writerDone))
+
+	// Fresh readers don't wait for the writer.
+	eq(t, oldTimed, mem.DedupNonBlockingFresh(failGetter(t), failTimer(t), BoolExpirer(false)))
+
+	// Expired readers still wait for the writer, and reuse its value.
+	go func() {
+		defer close(readerDone)
+		eq(t, newTimed, mem.DedupNonBlockingFresh(failGetter(t), failTimer(t), ExpirerNot{Inst(testTimes[1])}))
+	}()
+
+	time.Sleep(time.Millisecond)
+	eq(t, false, isDone(readerDone))
+
+	getter.Done()
+	<-writerDone
+	<-readerDone
+
+	eq(t, newTimed, mem.DedupNonBlockingFresh(failGetter(t), failTimer(t), BoolExpirer(false)))
+}
+
+func Test_Mem_DedupCtx(t *testing.T) {
+	mem := new(Mem)
+	ctx := context.Background()
+
+	val, err := mem.DedupCtx(ctx, Either{10}, Inst(testTimes[1]), BoolExpirer(true))
+	eq(t, nil, err)
+	eq(t, MakeTimed(10, testTimes[1]), val)
+
+	val, err = mem.DedupCtx(ctx, failGetter(t), failTimer(t), BoolExpirer(false))
+	eq(t, nil, err)
+	eq(t, MakeTimed(10, testTimes[1]), val)
+}
+
+func Test_Mem_DedupCtx_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	val, err := new(Mem).DedupCtx(ctx, failGetter(t), failTimer(t), nil)
+	eq(t, context.Canceled, err)
+	eq(t, Timed{}, val)
+}
+
+func Test_Mem_DedupCtx_cancel_blocked_reader(t *testing.T) {
+	mem := NewMem(MakeTimed(`old value`, time.Time{}))
+	mem.lock.Lock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := mem.DedupCtx(ctx, failGetter(t), failTimer(t), BoolExpirer(true))
+		done <- err
+	}()
+
+	// The reader can't finish while the lock is held. The sleep merely gives it
+	// a chance to reach the lock before cancelation.
+	time.Sleep(time.Millisecond)
+	eq(t, 0, len(done))
+
+	cancel()
+
+	select {
+	case err := <-done:
+		eq(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal(`expected canceled reader to return promptly`)
+	}
+
+	// The canceled call must not invoke the getter after acquiring the lock.
+	mem.lock.Unlock()
+	time.Sleep(time.Millisecond)
+	eq(t, MakeTimed(`old value`, time.Time{}), mem.GetTimed())
+}
+
+func Test_Mem_DedupDone(t *testing.T) {
+	var mem Mem
+
+	val, ok := mem.DedupDone(nil, Either{10}, Inst(testTimes[1]), nil)
+	eq(t, true, ok)
+	eq(t, MakeTimed(10, testTimes[1]), val)
+
+	val, ok = mem.DedupDone(make(chan struct{}), failGetter(t), failTimer(t), BoolExpirer(false))
+	eq(t, true, ok)
+	eq(t, MakeTimed(10, testTimes[1]), val)
+
+	done := make(chan struct{})
+	close(done)
+
+	val, ok = mem.DedupDone(done, failGetter(t), failTimer(t), nil)
+	eq(t, false, ok)
+	eq(t, Timed{}, val)
+}
+
+func Test_Mem_DedupDone_blocked_reader(t *testing.T) {
+	mem := NewMem(MakeTimed(`old value`, time.Time{}))
+	getter := newSlowGetter(`new value`)
+	writer := make(chan struct{})
+
+	go func() {
+		defer close(writer)
+		mem.Dedup(getter, Void{}, BoolExpirer(true))
+	}()
+
+	// The writer holds the write lock while it's inside the getter.
+	<-getter.Entered()
+
+	done := make(chan struct{})
+	reader := make(chan bool, 1)
+
+	go func() {
+		_, ok := mem.DedupDone(done, failGetter(t), failTimer(t), BoolExpirer(true))
+		reader <- ok
+	}()
+
+	time.Sleep(time.Millisecond)
+	eq(t, 0, len(reader))
+
+	close(done)
+
+	select {
+	case ok := <-reader:
+		eq(t, false, ok)
+	case <-time.After(time.Second):
+		t.Fatal(`expected blocked reader to return promptly`)
+	}
+
+	// The abandoned call must not invoke the getter after acquiring the lock.
+	getter.Done()
+	<-writer
+	time.Sleep(time.Millisecond)
+	eq(t, MakeTimed(`new value`, time.Time{}), mem.GetTimed())
+}
+
+func Test_Mem_DedupWithTimeout(t *testing.T) {
+	var mem Mem
+
+	slow := GetterFunc(func() interface{} {
+		time.Sleep(time.Millisecond)
+		return 10
+	})
+
+	val, err := mem.DedupWithTimeout(time.Second, slow, Inst(testTimes[1]), nil)
+	eq(t, nil, err)
+	eq(t, MakeTimed(10, testTimes[1]), val)
+
+	val, err = mem.DedupWithTimeout(time.Second, failGetter(t), failTimer(t), BoolExpirer(false))
+	eq(t, nil, err)
+	eq(t, MakeTimed(10, testTimes[1]), val)
+
+	val, err = mem.DedupWithTimeout(0, Either{20}, nil, nil)
+	eq(t, nil, err)
+	eq(t, MakeTimed(20, time.Time{}), val)
+}
+
+func Test_Mem_DedupWithTimeout_slow_getter(t *testing.T) {
+	var mem Mem
+	getter := newSlowGetter(`val`)
+	sub, unsub := mem.Subscribe()
+	defer unsub()
+
+	// The getter is blocked until `.Done`, so this always times out.
+	val, err := mem.DedupWithTimeout(time.Millisecond, getter, Inst(testTimes[1]), nil)
+	eq(t, ErrTimeout, err)
+	eq(t, Timed{}, val)
+
+	// The late result still populates the cache.
+	getter.Done()
+	eq(t, MakeTimed(`val`, testTimes[1]), <-sub)
+	eq(t, MakeTimed(`val`, testTimes[1]), mem.GetTimed())
+}
+
+func Test_Mem_DedupWithTimeout_waiting_for_writer(t *testing.T) {
+	mem := NewMem(MakeTimed(`old value`, time.Time{}))
+	sub, unsub := mem.Subscribe()
+	defer unsub()
+
+	// Simulates another writer, which holds the lock until we release it.
+	mem.lock.Lock()
+
+	val, err := mem.DedupWithTimeout(time.Millisecond, Either{`new value`}, nil, BoolExpirer(true))
+	eq(t, ErrTimeout, err)
+	eq(t, Timed{}, val)
+
+	// The timed-out call proceeds in the background once the lock is free.
+	mem.lock.Unlock()
+	eq(t, MakeTimed(`new value`, time.Time{}), <-sub)
+	eq(t, MakeTimed(`new value`, time.Time{}), mem.GetTimed())
+}
+
+func Test_Mem_DedupFallbackStale(t *testing.T) {
+	err := testErr()
+	good := MakeTimed(`good`, testTimes[1])
+	inst := Inst(time.Date(2, 3, 4, 5, 6, 7, 8, time.UTC))
+
+	t.Run(`failing refresh with prior good value`, func(t *testing.T) {
+		mem := NewMem(good)
+		eq(t, good, mem.DedupFallbackStale(Either{err}, inst, nil))
+		eq(t, good, mem.GetTimed())
+	})
+
+	t.Run(`failing refresh without prior value`, func(t *testing.T) {
+		var mem Mem
+		eq(t, MakeTimed(err, inst.Time()), mem.DedupFallbackStale(Either{err}, inst, nil))
+		eq(t, MakeTimed(err, inst.Time()), mem.GetTimed())
+	})
+
+	t.Run(`failing refresh with prior error`, func(t *testing.T) {
+		mem := NewMem(MakeTimed(testErr(), testTimes[1]))
+		eq(t, MakeTimed(err, inst.Time()), mem.DedupFallbackStale(Either{err}, inst, nil))
+	})
+
+	t.Run(`successful refresh`, func(t *testing.T) {
+		mem := NewMem(good)
+		eq(t, MakeTimed(`new`, inst.Time()), mem.DedupFallbackStale(Either{`new`}, inst, nil))
+		eq(t, MakeTimed(`new`, inst.Time()), mem.GetTimed())
+	})
+
+	t.Run(`fresh`, func(t *testing.T) {
+		mem := NewMem(good)
+		eq(t, good, mem.DedupFallbackStale(failGetter(t), failTimer(t), BoolExpirer(false)))
+	})
+}
+
+func Test_Mem_DedupIfChanged(t *testing.T) {
+	prev := MakeTimed([]int{10}, testTimes[1])
+	inst := Inst(time.Date(2, 3, 4, 5, 6, 7, 8, time.UTC))
+
+	t.Run(`equal by default`, func(t *testing.T) {
+		mem := NewMem(prev)
+		eq(t, prev, mem.DedupIfChanged(Either{[]int{10}}, inst, nil, nil))
+		eq(t, prev, mem.GetTimed())
+		eq(t, uint64(0), mem.Generation())
+	})
+
+	t.Run(`unequal by default`, func(t *testing.T) {
+		mem := NewMem(prev)
+		eq(t, MakeTimed([]int{20}, inst.Time()), mem.DedupIfChanged(Either{[]int{20}}, inst, nil, nil))
+		eq(t, MakeTimed([]int{20}, inst.Time()), mem.GetTimed())
+		eq(t, uint64(1), mem.Generation())
+	})
+
+	t.Run(`custom equality`, func(t *testing.T) {
+		always := func(interface{}, interface{}) bool { return true }
+		never := func(interface{}, interface{}) bool { return false }
+
+		mem := NewMem(prev)
+		eq(t, prev, mem.DedupIfChanged(Either{[]int{20}}, inst, nil, always))
+		eq(t, prev, mem.GetTimed())
+
+		eq(t, MakeTimed([]int{10}, inst.Time()), mem.DedupIfChanged(Either{[]int{10}}, inst, nil, never))
+		eq(t, MakeTimed([]int{10}, inst.Time()), mem.GetTimed())
+	})
+
+	t.Run(`fresh`, func(t *testing.T) {
+		mem := NewMem(prev)
+		eq(t, prev, mem.DedupIfChanged(failGetter(t), failTimer(t), BoolExpirer(false), nil))
+	})
+}
+
+func Test_Tiered(t *testing.T) {
+	clock := &testClock{inst: testTimes[1]}
+	tier := Tiered{Fresh: time.Minute, Stale: time.Hour, Clock: clock}
+	val := MakeTimed(10, testTimes[1])
+
+	eq(t, true, tier.IsStale(Timed{}))
+	eq(t, true, tier.IsExpired(Timed{}))
+
+	eq(t, false, tier.IsStale(val))
+	eq(t, false, tier.IsExpired(val))
+
+	clock.Add(time.Minute * 2)
+	eq(t, true, tier.IsStale(val))
+	eq(t, false, tier.IsExpired(val))
+
+	clock.Add(time.Hour)
+	eq(t, true, tier.IsStale(val))
+	eq(t, true, tier.IsExpired(val))
+}
+
+func Test_Mem_DedupTiered(t *testing.T) {
+	clock := &testClock{inst: testTimes[1]}
+	tier := Tiered{Fresh: time.Minute, Stale: time.Hour, Clock: clock}
+	timer := NowTimerClock(clock)
+	var mem Mem
+
+	// Zero is dead: blocks and regenerates.
+	first := MakeTimed(`first`, clock.Now())
+	eq(t, first, mem.DedupTiered(Either{`first`}, timer, tier))
+
+	// Fresh: served directly.
+	clock.Add(time.Second * 30)
+	eq(t, first, mem.DedupTiered(failGetter(t), failTimer(t), tier))
+
+	// Stale: served immediately, refreshed in the background.
+	clock.Add(time.Minute)
+	getter := newSlowGetter(`second`)
+	eq(t, first, mem.DedupTiered(getter, timer, tier))
+	eq(t, first, mem.DedupTiered(failGetter(t), failTimer(t), tier))
+
+	getter.Done()
+	for atomic.LoadUint32(&mem.stale) != 0 {
+		runtime.Gosched()
+	}
+
+	second := MakeTimed(`second`, clock.Now())
+	eq(t, second, mem.GetTimed())
+	eq(t, second, mem.DedupTiered(failGetter(t), failTimer(t), tier))
+
+	// Dead: blocks and regenerates.
+	clock.Add(time.Hour * 2)
+	third := MakeTimed(`third`, clock.Now())
+	eq(t, third, mem.DedupTiered(Either{`third`}, timer, tier))
+	eq(t, third, mem.GetTimed())
+}
+
+func Test_Mem_DedupStale_from_zero(t *testing.T) {
+	mem := new(Mem)
+	eq(t, MakeTimed(10, testTimes[1]), mem.DedupStale(Either{10}, Inst(testTimes[1]), nil))
+	eq(t, MakeTimed(10, testTimes[1]), mem.GetTimed())
+}
+
+func Test_Mem_DedupStale_fresh(t *testing.T) {
+	timed := MakeTimed(`old value`, testTimes[1])
+	mem := NewMem(timed)
+	eq(t, timed, mem.DedupStale(failGetter(t), failTimer(t), BoolExpirer(false)))
+}
+
+func Test_Mem_DedupStale_burst(t *testing.T) {
+	oldTimed := MakeTimed(`old value`, testTimes[1])
+	newTimed := MakeTimed(`new value`, time.Date(2, 3, 4, 5, 6, 7, 8, time.UTC))
+	mem := NewMem(oldTimed)
+	getter := newSlowGetter(newTimed.Get())
+
+	var calls int64
+	counted := GetterFunc(func() interface{} {
+		atomic.AddInt64(&calls, 1)
+		return getter.Get()
+	})
+
+	const count = 8
+	var wg sync.WaitGroup
+	for range counter(count) {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			eq(t, oldTimed, mem.DedupStale(counted, Inst(newTimed.Time), BoolExpirer(true)))
+		}()
+	}
+	wg.Wait()
+
+	// The background refresh doesn't hold the lock while the getter is running.
+	eq(t, oldTimed, mem.GetTimed())
+
+	getter.Done()
+	for atomic.LoadUint32(&mem.stale) != 0 {
+		runtime.Gosched()
+	}
+
+	eq(t, int64(1), atomic.LoadInt64(&calls))
+	eq(t, newTimed, mem.GetTimed())
+}
+
+func Test_Now(t *testing.T) {
+	eq(t, testTimes[1], Now(&testClock{inst: testTimes[1]}))
+
+	before := time.Now()
+	inst := Now(nil)
+	eq(t, false, inst.Before(before))
+}
+
+func Test_NowTimerClock(t *testing.T) {
+	clock := &testClock{inst: testTimes[1]}
+	timer := NowTimerClock(clock)
+	eq(t, testTimes[1], timer.Time())
+
+	clock.Add(time.Hour)
+	eq(t, testTimes[1].Add(time.Hour), timer.Time())
+}
+
+func Test_NowExpirerClock(t *testing.T) {
+	clock := &testClock{inst: testTimes[1]}
+	exp := NowExpirerClock(clock)
+	timed := MakeTimed(nil, testTimes[1])
+
+	eq(t, false, exp.IsExpired(timed))
+
+	clock.Add(time.Nanosecond)
+	eq(t, true, exp.IsExpired(timed))
+}
+
+func Test_DurationClock(t *testing.T) {
+	clock := &testClock{inst: testTimes[1]}
+	exp := DurationClock(clock, time.Minute)
+	timed := MakeTimed(nil, testTimes[1])
+
+	eq(t, false, exp.IsExpired(timed))
+
+	clock.Add(time.Minute)
+	eq(t, false, exp.IsExpired(timed))
+
+	clock.Add(time.Nanosecond)
+	eq(t, true, exp.IsExpired(timed))
+}
+
+func Test_IsExpiredAt(t *testing.T) {
+	timed := MakeTimed(nil, testTimes[1])
+	now := testTimes[1]
+
+	eq(t, true, IsExpiredAt(nil, timed, now))
+	eq(t, false, IsExpiredAt(BoolExpirer(false), timed, now))
+	eq(t, true, IsExpiredAt(BoolExpirer(true), timed, now))
+
+	eq(t, false, IsExpiredAt(NowExpirer{}, timed, now))
+	eq(t, true, IsExpiredAt(NowExpirer{}, timed, now.Add(time.Nanosecond)))
+	eq(t, true, NowExpirer{}.IsExpired(timed))
+
+	eq(t, false, IsExpiredAt(Duration(time.Minute), timed, now.Add(time.Minute)))
+	eq(t, true, IsExpiredAt(Duration(time.Minute), timed, now.Add(time.Minute+time.Nanosecond)))
+	eq(t, true, Duration(time.Minute).IsExpired(timed))
+
+	eq(t, false, IsExpiredAt(Inst(now), timed, time.Time{}))
+	eq(t, true, IsExpiredAt(Inst(now.Add(-time.Nanosecond)), timed, time.Time{}))
+}
+
+func Test_Mem_DedupAt(t *testing.T) {
+	var mem Mem
+	now := testTimes[1]
+	exp := Duration(time.Minute)
+
+	eq(t, MakeTimed(10, now), mem.DedupAt(now, Either{10}, Inst(now), exp))
+	eq(t, MakeTimed(10, now), mem.DedupAt(now.Add(time.Minute), failGetter(t), failTimer(t), exp))
+	eq(t, MakeTimed(20, now), mem.DedupAt(now.Add(time.Hour), Either{20}, Inst(now), exp))
+
+	// Expirers without `.IsExpiredAt` are called as usual.
+	eq(t, MakeTimed(20, now), mem.DedupAt(time.Time{}, failGetter(t), failTimer(t), BoolExpirer(false)))
+	eq(t, MakeTimed(30, now), mem.DedupAt(time.Time{}, Either{30}, Inst(now), nil))
+}
+
+func Test_Mem_Dedup_with_clock(t *testing.T) {
+	clock := &testClock{inst: testTimes[1]}
+	timer := NowTimerClock(clock)
+	exp := DurationClock(clock, time.Minute)
+	var mem Mem
+
+	eq(t, MakeTimed(10, testTimes[1]), mem.Dedup(Either{10}, timer, exp))
+
+	clock.Add(time.Minute)
+	eq(t, MakeTimed(10, testTimes[1]), mem.Dedup(Either{20}, timer, exp))
+
+	clock.Add(time.Second)
+	eq(t, MakeTimed(20, clock.Now()), mem.Dedup(Either{20}, timer, exp))
+}
+
+func Test_ExpirerAnd(t *testing.T) {
+	test := func(exp bool, src ExpirerAnd) {
+		t.Helper()
+		eq(t, exp, src.IsExpired(Timed{}))
+	}
+
+	test(true, nil)
+	test(true, ExpirerAnd{})
+	test(true, ExpirerAnd{nil})
+	test(true, ExpirerAnd{nil, BoolExpirer(true)})
+	test(false, ExpirerAnd{nil, BoolExpirer(false)})
+	test(false, ExpirerAnd{BoolExpirer(false), BoolExpirer(true)})
+	test(true, ExpirerAnd{BoolExpirer(true), BoolExpirer(true)})
+}
+
+func Test_ExpirerOr(t *testing.T) {
+	test := func(exp bool, src ExpirerOr) {
+		t.Helper()
+		eq(t, exp, src.IsExpired(Timed{}))
+	}
+
+	test(false, nil)
+	test(false, ExpirerOr{})
+	test(true, ExpirerOr{nil})
+	test(true, ExpirerOr{nil, BoolExpirer(false)})
+	test(false, ExpirerOr{BoolExpirer(false), BoolExpirer(false)})
+	test(true, ExpirerOr{BoolExpirer(false), BoolExpirer(true)})
+}
+
+func Test_ExpirerNot(t *testing.T) {
+	eq(t, false, ExpirerNot{}.IsExpired(Timed{}))
+	eq(t, true, ExpirerNot{BoolExpirer(false)}.IsExpired(Timed{}))
+	eq(t, false, ExpirerNot{BoolExpirer(true)}.IsExpired(Timed{}))
+}
+
+func Test_ExpirerNot_window(t *testing.T) {
+	// Expired when older than a minute, but only while still within an hour.
+	exp := ExpirerAnd{Duration(time.Minute), ExpirerNot{Duration(time.Hour)}}
+	now := time.Now()
+
+	eq(t, false, exp.IsExpired(MakeTimed(nil, now)))
+	eq(t, true, exp.IsExpired(MakeTimed(nil, now.Add(-time.Minute*2))))
+	eq(t, false, exp.IsExpired(MakeTimed(nil, now.Add(-time.Hour*2))))
+}
+
+func Test_DurationJitter_Offset(t *testing.T) {
+	exp := DurationJitter{Base: time.Minute, Jitter: time.Second}
+	inst := time.Date(2, 3, 4, 5, 6, 7, 8, time.UTC)
+
+	eq(t, exp.Offset(inst), exp.Offset(inst))
+
+	for i := range counter(64) {
+		off := exp.Offset(inst.Add(time.Duration(i)))
+		eq(t, true, off >= 0 && off < time.Second)
+	}
+
+	eq(t, false, exp.Offset(inst) == DurationJitter{Jitter: time.Second, Seed: 1}.Offset(inst))
+	eq(t, time.Duration(0), DurationJitter{Base: time.Minute}.Offset(inst))
+	eq(t, time.Duration(0), DurationJitter{Jitter: -time.Second}.Offset(inst))
+}
+
+func Test_DurationJitter_IsExpired(t *testing.T) {
+	exp := DurationJitter{Base: time.Minute, Jitter: time.Minute, Seed: 123}
+	now := time.Now()
+
+	eq(t, false, exp.IsExpired(MakeTimed(nil, now)))
+	eq(t, true, exp.IsExpired(MakeTimed(nil, now.Add(-time.Minute*2))))
+}
+
+func Test_Mem_DedupRetryErr(t *testing.T) {
+	var calls int
+	err := testErr()
+
+	failing := GetterFunc(func() interface{} {
+		calls++
+		return err
+	})
+
+	var mem Mem
+	for i := range counter(3) {
+		eq(t, MakeTimed(err, testTimes[1]), mem.DedupRetryErr(failing, Inst(testTimes[1]), Duration(time.Hour)))
+		eq(t, Timed{}, mem.GetTimed())
+		eq(t, i+1, calls)
+	}
+
+	succeeding := GetterFunc(func() interface{} {
+		calls++
+		return `val`
+	})
+
+	now := time.Now()
+	for range counter(3) {
+		eq(t, MakeTimed(`val`, now), mem.DedupRetryErr(succeeding, Inst(now), Duration(time.Hour)))
+		eq(t, MakeTimed(`val`, now), mem.GetTimed())
+		eq(t, 4, calls)
+	}
+}
+
+func Test_Mem_DedupArg(t *testing.T) {
+	var mem Mem
+	var args []interface{}
+
+	getter := func(arg interface{}) interface{} {
+		args = append(args, arg)
+		return arg.(int) * 2
+	}
+
+	eq(t, MakeTimed(20, testTimes[1]), mem.DedupArg(10, getter, Inst(testTimes[1]), nil))
+	eq(t, MakeTimed(20, testTimes[1]), mem.DedupArg(30, getter, failTimer(t), BoolExpirer(false)))
+	eq(t, MakeTimed(60, time.Time{}), mem.DedupArg(30, getter, nil, BoolExpirer(true)))
+	eq(t, []interface{}{10, 30}, args)
+
+	eq(t, MakeTimed(nil, time.Time{}), mem.DedupArg(40, nil, nil, nil))
+
+	getter = func(interface{}) interface{} { panic(testErr()) }
+	eq(t, MakeTimed(testErr(), time.Time{}), mem.DedupArg(50, getter, nil, nil))
+}
+
+func Test_Mem_DedupArg_concurrent(t *testing.T) {
+	var mem Mem
+	var calls int64
+	slow := newSlowGetter(`unused`)
+
+	getter := func(arg interface{}) interface{} {
+		atomic.AddInt64(&calls, 1)
+		slow.Get()
+		return arg
+	}
+
+	const count = 8
+	out := make(chan interface{}, count)
+	var wg sync.WaitGroup
+	for i := range counter(count) {
+		wg.Add(1)
+		go func(arg int) {
+			defer wg.Add(-1)
+			out <- mem.DedupArg(arg, getter, nil, IsZeroExpirer{}).Get()
+		}(i)
+	}
+
+	slow.Done()
+	wg.Wait()
+	close(out)
+
+	// Only one argument wins, and everyone gets its result.
+	eq(t, int64(1), calls)
+	winner := mem.Get()
+	for val := range out {
+		eq(t, winner, val)
+	}
+}
+
+func Test_Mem_DedupExpiring(t *testing.T) {
+	var mem Mem
+	var calls int
+
+	future := time.Now().Add(time.Hour)
+	getter := ExpiringGetterFunc(func() (interface{}, time.Time) {
+		calls++
+		return calls, future
+	})
+
+	eq(t, MakeTimed(1, future), mem.DedupExpiring(getter, NowExpirer{}))
+	eq(t, MakeTimed(1, future), mem.DedupExpiring(getter, NowExpirer{}))
+	eq(t, 1, calls)
+
+	// The getter decides that the next value is already stale.
+	past := time.Now().Add(-time.Hour)
+	getter = func() (interface{}, time.Time) {
+		calls++
+		return calls, past
+	}
+
+	eq(t, MakeTimed(1, future), mem.DedupExpiring(getter, NowExpirer{}))
+	eq(t, MakeTimed(2, past), mem.DedupExpiring(getter, BoolExpirer(true)))
+	eq(t, MakeTimed(3, past), mem.DedupExpiring(getter, NowExpirer{}))
+	eq(t, MakeTimed(4, past), mem.DedupExpiring(getter, NowExpirer{}))
+	eq(t, 4, calls)
+}
+
+func Test_Mem_DedupExpiring_err(t *testing.T) {
+	var mem Mem
+
+	eq(
+		t,
+		MakeTimed(testErr(), testTimes[1]),
+		mem.DedupExpiring(
+			ExpiringGetterFunc(func() (interface{}, time.Time) { return testErr(), testTimes[1] }),
+			nil,
+		),
+	)
+
+	// Panics leave the timestamp zero, so the error expires immediately.
+	eq(
+		t,
+		MakeTimed(testErr(), time.Time{}),
+		mem.DedupExpiring(
+			ExpiringGetterFunc(func() (interface{}, time.Time) { panic(testErr()) }),
+			nil,
+		),
+	)
+	eq(t, true, NowExpirer{}.IsExpired(mem.GetTimed()))
+
+	eq(t, MakeTimed(nil, time.Time{}), mem.DedupExpiring(nil, nil))
+	eq(t, MakeTimed(nil, time.Time{}), mem.DedupExpiring(ExpiringGetterFunc(nil), nil))
+}
+
+func Test_Mem_DedupMap(t *testing.T) {
+	var calls int
+	double := func(val interface{}) interface{} {
+		calls++
+		return val.(int) * 2
+	}
+
+	var mem Mem
+	eq(t, MakeTimed(20, testTimes[1]), mem.DedupMap(Either{10}, Inst(testTimes[1]), nil, double))
+	eq(t, 1, calls)
+
+	eq(t, MakeTimed(20, testTimes[1]), mem.DedupMap(failGetter(t), failTimer(t), BoolExpirer(false), double))
+	eq(t, 1, calls)
+
+	eq(t, MakeTimed(40, testTimes[1]), mem.DedupMap(Either{20}, Inst(testTimes[1]), nil, double))
+	eq(t, 2, calls)
+
+	err := testErr()
+	eq(t, MakeTimed(err, testTimes[1]), mem.DedupMap(Either{err}, Inst(testTimes[1]), nil, double))
+	eq(t, 2, calls)
+
+	eq(t, MakeTimed(err, testTimes[1]), mem.DedupMap(GetterFunc(func() interface{} { panic(err) }), Inst(testTimes[1]), nil, double))
+	eq(t, 2, calls)
+
+	eq(t, MakeTimed(err, testTimes[1]), mem.DedupMap(Either{10}, Inst(testTimes[1]), nil, func(interface{}) interface{} { panic(err) }))
+
+	eq(t, MakeTimed(10, testTimes[1]), mem.DedupMap(Either{10}, Inst(testTimes[1]), nil, nil))
+}
+
+func Test_Mem_DedupHooked(t *testing.T) {
+	var hits, misses []Timed
+	hooks := Hooks{
+		OnHit:  func(val Timed) { hits = append(hits, val) },
+		OnMiss: func(val Timed) { misses = append(misses, val) },
+	}
+
+	var mem Mem
+	timed := MakeTimed(10, testTimes[1])
+
+	eq(t, timed, mem.DedupHooked(Either{10}, Inst(testTimes[1]), BoolExpirer(true), hooks))
+	eq(t, []Timed(nil), hits)
+	eq(t, []Timed{timed}, misses)
+
+	eq(t, timed, mem.DedupHooked(failGetter(t), failTimer(t), BoolExpirer(false), hooks))
+	eq(t, []Timed{timed}, hits)
+	eq(t, []Timed{timed}, misses)
+}
+
+func Test_Mem_DedupHooked_nil_callbacks(t *testing.T) {
+	var mem Mem
+	mem.DedupHooked(Either{10}, nil, BoolExpirer(true), Hooks{})
+	mem.DedupHooked(failGetter(t), failTimer(t), BoolExpirer(false), Hooks{})
+}
+
+func Test_Mem_DedupHooked_concurrent(t *testing.T) {
+	mem := new(Mem)
+	getter := newSlowGetter(`val`)
+	var hits, misses int64
+
+	hooks := Hooks{
+		OnHit:  func(Timed) { atomic.AddInt64(&hits, 1) },
+		OnMiss: func(Timed) { atomic.AddInt64(&misses, 1) },
+	}
+
+	const count = 8
+	var wg sync.WaitGroup
+	for range counter(count) {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			mem.DedupHooked(getter, Void{}, IsZeroExpirer{}, hooks)
+		}()
+	}
+
+	getter.Done()
+	wg.Wait()
+
+	eq(t, int64(1), misses)
+	eq(t, int64(count-1), hits)
+}
+
+func Test_MeteredMem(t *testing.T) {
+	var mem MeteredMem
+	eq(t, Stats{}, mem.Stats())
+
+	mem.Dedup(Either{10}, nil, nil)
+	eq(t, Stats{Misses: 1}, mem.Stats())
+
+	mem.Dedup(failGetter(t), failTimer(t), BoolExpirer(false))
+	eq(t, Stats{Hits: 1, Misses: 1}, mem.Stats())
+
+	mem.Dedup(Either{testErr()}, nil, nil)
+	eq(t, Stats{Hits: 1, Misses: 2, Errors: 1}, mem.Stats())
+}
+
+func Test_MeteredMem_concurrent(t *testing.T) {
+	var mem MeteredMem
+	getter := newSlowGetter(testErr())
+
+	const count = 16
+	var wg sync.WaitGroup
+	for range counter(count) {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			mem.Dedup(getter, Void{}, IsZeroExpirer{})
+		}()
+	}
+
+	getter.Done()
+	wg.Wait()
+
+	eq(t, Stats{Hits: count - 1, Misses: 1, Errors: 1}, mem.Stats())
+}
+
+func Test_Mem_Warm(t *testing.T) {
+	var mem Mem
+	mem.Warm(Either{10}, Inst(testTimes[1]))
+	eq(t, MakeTimed(10, testTimes[1]), mem.GetTimed())
+
+	mem.Warm(failGetter(t), failTimer(t))
+	eq(t, MakeTimed(10, testTimes[1]), mem.GetTimed())
+	eq(t, uint64(1), mem.Generation())
+
+	// Even an expired or failed state counts as populated.
+	failed := NewMem(MakeTimed(testErr(), time.Time{}))
+	failed.Warm(failGetter(t), failTimer(t))
+	eq(t, MakeTimed(testErr(), time.Time{}), failed.GetTimed())
+}
+
+func Test_Mem_DedupOnce(t *testing.T) {
+	var mem Mem
+	eq(t, MakeTimed(10, testTimes[1]), mem.DedupOnce(Either{10}, Inst(testTimes[1])))
+	eq(t, MakeTimed(10, testTimes[1]), mem.DedupOnce(failGetter(t), failTimer(t)))
+
+	// Other writes replace the state, but don't reset the guard.
+	mem.Zero()
+	eq(t, Timed{}, mem.DedupOnce(failGetter(t), failTimer(t)))
+}
+
+func Test_Mem_DedupOnce_err(t *testing.T) {
+	var mem Mem
+	err := testErr()
+	eq(t, MakeTimed(err, time.Time{}), mem.DedupOnce(GetterFunc(func() interface{} { panic(err) }), nil))
+	eq(t, MakeTimed(err, time.Time{}), mem.DedupOnce(failGetter(t), failTimer(t)))
+}
+
+func Test_Mem_DedupOnce_concurrent(t *testing.T) {
+	var mem Mem
+	var calls int64
+	slow := newSlowGetter(`val`)
+
+	getter := GetterFunc(func() interface{} {
+		atomic.AddInt64(&calls, 1)
+		return slow.Get()
+	})
+
+	var wg sync.WaitGroup
+	for range counter(8) {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			eq(t, MakeTimed(`val`, time.Time{}), mem.DedupOnce(getter, nil))
+		}()
+	}
+
+	// Other callers either wait for the writer, or arrive later and find the
+	// cached value. Either way, the getter runs once.
+	<-slow.Entered()
+	slow.Done()
+	wg.Wait()
+	eq(t, int64(1), calls)
+}
+
+func Test_Mem_DedupFunc(t *testing.T) {
+	for _, val := range testVals {
+		for _, inst := range testTimes {
+			for _, expirer := range testExpirers {
+				get := func() interface{} { return val }
+				tim := func() time.Time { return inst }
+
+				var exp, act Mem
+				eq(t, exp.Dedup(GetterFunc(get), TimerFunc(tim), expirer), act.DedupFunc(get, tim, expirer))
+				eq(t, exp.GetTimed(), act.GetTimed())
+			}
+		}
+	}
+
+	var mem Mem
+	eq(t, Timed{}, mem.DedupFunc(nil, nil, nil))
+
+	mem.SetTimed(MakeTimed(10, testTimes[1]))
+	eq(t, MakeTimed(10, testTimes[1]), mem.DedupFunc(nil, nil, BoolExpirer(false)))
+}
+
+func Test_Mem_DedupE(t *testing.T) {
+	var mem Mem
+
+	val, err := mem.DedupE(nil, nil, nil)
+	eq(t, nil, val)
+	eq(t, nil, err)
+
+	val, err = mem.DedupE(Either{10}, Inst(testTimes[1]), nil)
+	eq(t, 10, val)
+	eq(t, nil, err)
+	eq(t, MakeTimed(10, testTimes[1]), mem.GetTimed())
+
+	val, err = mem.DedupE(failGetter(t), failTimer(t), BoolExpirer(false))
+	eq(t, 10, val)
+	eq(t, nil, err)
+
+	val, err = mem.DedupE(Either{testErr()}, Inst(testTimes[1]), nil)
+	eq(t, nil, val)
+	eq(t, testErr(), err)
+	eq(t, MakeTimed(testErr(), testTimes[1]), mem.GetTimed())
+
+	val, err = mem.DedupE(failGetter(t), failTimer(t), BoolExpirer(false))
+	eq(t, nil, val)
+	eq(t, testErr(), err)
+}
+
+func Test_Mem_DedupReport(t *testing.T) {
+	var mem Mem
+	timed := MakeTimed(10, testTimes[1])
+
+	val, regen := mem.DedupReport(Either{10}, Inst(testTimes[1]), nil)
+	eq(t, timed, val)
+	eq(t, true, regen)
+
+	val, regen = mem.DedupReport(failGetter(t), failTimer(t), BoolExpirer(false))
+	eq(t, timed, val)
+	eq(t, false, regen)
+}
+
+func Test_Mem_DedupReport_concurrent(t *testing.T) {
+	mem := new(Mem)
+	getter := newSlowGetter(`val`)
+	var regens int64
+
+	const count = 8
+	var wg sync.WaitGroup
+	for range counter(count) {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			val, regen := mem.DedupReport(getter, Void{}, IsZeroExpirer{})
+			eq(t, MakeTimed(`val`, time.Time{}), val)
+			if regen {
+				atomic.AddInt64(&regens, 1)
+			}
+		}()
+	}
+
+	getter.Done()
+	wg.Wait()
+	eq(t, int64(1), regens)
+}
+
+func Test_Mem_DedupElapsed(t *testing.T) {
+	const delay = time.Millisecond * 10
+	var mem Mem
+
+	getter := GetterFunc(func() interface{} {
+		time.Sleep(delay)
+		return `val`
+	})
+
+	val, elapsed := mem.DedupElapsed(getter, Inst(testTimes[1]), IsZeroExpirer{})
+	eq(t, MakeTimed(`val`, testTimes[1]), val)
+	eq(t, true, elapsed >= delay)
+
+	val, elapsed = mem.DedupElapsed(failGetter(t), failTimer(t), IsZeroExpirer{})
+	eq(t, MakeTimed(`val`, testTimes[1]), val)
+	eq(t, time.Duration(0), elapsed)
+
+	// Panicking getters are measured too.
+	getter = GetterFunc(func() interface{} {
+		time.Sleep(delay)
+		panic(testErr())
+	})
+
+	val, elapsed = mem.DedupElapsed(getter, nil, nil)
+	eq(t, MakeTimed(testErr(), time.Time{}), val)
+	eq(t, true, elapsed >= delay)
+
+	val, elapsed = mem.DedupElapsed(nil, nil, nil)
+	eq(t, Timed{}, val)
+	eq(t, true, elapsed < delay)
+}
+
+func Test_Mem_DedupElapsed_waiting_for_writer(t *testing.T) {
+	var mem Mem
+	getter := newSlowGetter(`val`)
+	done := make(chan time.Duration, 1)
+
+	go func() {
+		_, elapsed := mem.DedupElapsed(getter, nil, IsZeroExpirer{})
+		done <- elapsed
+	}()
+
+	// The writer holds the write lock while it's inside the getter.
+	<-getter.Entered()
+
+	go getter.Done()
+	val, elapsed := mem.DedupElapsed(failGetter(t), failTimer(t), IsZeroExpirer{})
+	eq(t, MakeTimed(`val`, time.Time{}), val)
+	eq(t, time.Duration(0), elapsed)
+	eq(t, true, <-done > 0)
+}
+
+func Test_Window(t *testing.T) {
+	eq(t, time.Hour, Window{Min: time.Minute, Max: time.Hour}.Limit())
+	eq(t, time.Hour, Window{Min: time.Hour, Max: time.Minute}.Limit())
+	eq(t, time.Hour, Window{Min: time.Hour}.Limit())
+	eq(t, time.Duration(0), Window{}.Limit())
+
+	test := func(exp bool, win Window, age time.Duration) {
+		t.Helper()
+		eq(t, exp, win.IsExpired(MakeTimed(nil, time.Now().Add(-age))))
+	}
+
+	win := Window{Min: time.Minute, Max: time.Hour}
+	test(false, win, 0)
+	test(false, win, time.Minute-time.Second)
+	test(false, win, time.Minute+time.Second)
+	test(false, win, time.Hour-time.Second)
+	test(true, win, time.Hour+time.Second)
+
+	// `Max` below `Min` is clamped.
+	win = Window{Min: time.Hour, Max: time.Minute}
+	test(false, win, time.Minute+time.Second)
+	test(false, win, time.Hour-time.Second)
+	test(true, win, time.Hour+time.Second)
+}
+
+type testGobVal struct {
+	Name  string
+	Count int
+}
+
+type testGobErr struct{ Msg string }
+
+func (self testGobErr) Error() string { return self.Msg }
+
+func init() {
+	gob.Register(testGobVal{})
+	gob.Register(testGobErr{})
+}
+
+func testGobRoundTrip(t testing.TB, src Timed) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(NewMem(src))
+	eq(t, nil, err)
+
+	var tar Mem
+	err = gob.NewDecoder(&buf).Decode(&tar)
+	eq(t, nil, err)
+	eq(t, src, tar.GetTimed())
+}
+
+func Test_Mem_gob(t *testing.T) {
+	testGobRoundTrip(t, Timed{})
+	testGobRoundTrip(t, MakeTimed(testGobVal{`one`, 10}, testTimes[1]))
+	testGobRoundTrip(t, MakeTimed(testGobErr{`some error`}, testTimes[1]))
+}
+
+func Test_Mem_gob_unregistered(t *testing.T) {
+	_, err := NewMem(MakeTimed(testErr(), testTimes[1])).GobEncode()
+	eq(t, true, err != nil)
+}
+
+func Test_RefreshAhead_Limit(t *testing.T) {
+	test := func(exp time.Duration, ratio float64) {
+		t.Helper()
+		eq(t, exp, RefreshAhead{time.Minute, ratio}.Limit())
+	}
+
+	test(time.Second*48, 0.8)
+	test(time.Second*30, 0.5)
+	test(time.Minute, 1)
+	test(time.Minute, 0)
+	test(time.Minute, -0.5)
+	test(time.Minute, 1.5)
+	test(time.Minute, math.NaN())
+}
+
+func Test_RefreshAhead_IsExpired(t *testing.T) {
+	test := func(ratio float64) {
+		t.Helper()
+		exp := RefreshAhead{time.Minute, ratio}
+		limit := exp.Limit()
+		now := time.Now()
+
+		eq(t, false, exp.IsExpired(MakeTimed(nil, now)))
+		eq(t, false, exp.IsExpired(MakeTimed(nil, now.Add(-limit+time.Second))))
+		eq(t, true, exp.IsExpired(MakeTimed(nil, now.Add(-limit))))
+		eq(t, true, exp.IsExpired(MakeTimed(nil, now.Add(-limit-time.Second))))
+	}
+
+	test(0.25)
+	test(0.5)
+	test(0.8)
+	test(1)
+}
+
+func Test_CountExpirer(t *testing.T) {
+	exp := &CountExpirer{Max: 2}
+	eq(t, true, exp.IsExpired(Timed{}))
+
+	one := MakeTimed(nil, testTimes[1])
+	eq(t, false, exp.IsExpired(one))
+	eq(t, false, exp.IsExpired(one))
+	eq(t, true, exp.IsExpired(one))
+	eq(t, true, exp.IsExpired(one))
+
+	two := MakeTimed(nil, testTimes[1].Add(time.Second))
+	eq(t, false, exp.IsExpired(two))
+
+	// Older values are expired, and don't reset the count of the newer one.
+	eq(t, true, exp.IsExpired(one))
+	eq(t, false, exp.IsExpired(two))
+	eq(t, true, exp.IsExpired(two))
+}
+
+func Test_CountExpirer_Mem_Dedup(t *testing.T) {
+	var mem Mem
+	var calls int
+	exp := &CountExpirer{Max: 4}
+	clock := &testClock{inst: testTimes[1]}
+	timer := NowTimerClock(clock)
+
+	getter := GetterFunc(func() interface{} {
+		calls++
+		clock.Add(time.Second)
+		return calls
+	})
+
+	for range counter(100) {
+		mem.Dedup(getter, timer, exp)
+	}
+
+	// Each value is served by its writer, plus `Max` readers.
+	eq(t, 20, calls)
+}
+
+func Test_CountExpirer_concurrent(t *testing.T) {
+	var mem Mem
+	var calls int64
+	exp := &CountExpirer{Max: 4}
+	clock := &testClock{inst: testTimes[1]}
+	timer := NowTimerClock(clock)
+
+	getter := GetterFunc(func() interface{} {
+		clock.Add(time.Second)
+		return atomic.AddInt64(&calls, 1)
+	})
+
+	const count = 200
+	out := make(chan interface{}, count)
+	var wg sync.WaitGroup
+	for range counter(count) {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			out <- mem.Dedup(getter, timer, exp).Get()
+		}()
+	}
+	wg.Wait()
+	close(out)
+
+	served := map[interface{}]int64{}
+	for val := range out {
+		served[val]++
+	}
+
+	// Each value is served by its writer, plus at most `Max` readers.
+	for val, num := range served {
+		if num > exp.Max+1 {
+			t.Fatalf(`value %v served %v times, expected at most %v`, val, num, exp.Max+1)
+		}
+	}
+	eq(t, calls, int64(len(served)))
+}
+
+func Test_FlagExpirer(t *testing.T) {
+	var exp FlagExpirer
+	eq(t, true, exp.IsExpired(Timed{}))
+
+	one := MakeTimed(nil, testTimes[1])
+	eq(t, false, exp.IsExpired(one))
+	eq(t, false, exp.IsInvalidated())
+
+	exp.Invalidate()
+	exp.Invalidate()
+	eq(t, true, exp.IsInvalidated())
+
+	// Survives repeated checks of the stale value.
+	eq(t, true, exp.IsExpired(one))
+	eq(t, true, exp.IsExpired(one))
+	eq(t, true, exp.IsInvalidated())
+
+	// Cleared by observing a new value.
+	two := MakeTimed(nil, testTimes[1].Add(time.Second))
+	eq(t, false, exp.IsExpired(two))
+	eq(t, false, exp.IsInvalidated())
+	eq(t, false, exp.IsExpired(one))
+	eq(t, false, exp.IsExpired(two))
+}
+
+func Test_FlagExpirer_concurrent(t *testing.T) {
+	var mem Mem
+	var calls int64
+	var exp FlagExpirer
+	clock := &testClock{inst: testTimes[1]}
+	timer := NowTimerClock(clock)
+
+	getter := GetterFunc(func() interface{} {
+		clock.Add(time.Second)
+		return atomic.AddInt64(&calls, 1)
+	})
+
+	dedup := func() {
+		const count = 64
+		var wg sync.WaitGroup
+		for range counter(count) {
+			wg.Add(1)
+			go func() {
+				defer wg.Add(-1)
+				mem.Dedup(getter, timer, &exp)
+			}()
+		}
+		wg.Wait()
+	}
+
+	dedup()
+	eq(t, int64(1), calls)
+
+	exp.Invalidate()
+	dedup()
+	eq(t, int64(2), calls)
+	eq(t, false, exp.IsInvalidated())
+
+	// Caching resumes.
+	dedup()
+	eq(t, int64(2), calls)
+	eq(t, MakeTimed(int64(2), clock.Now()), mem.GetTimed())
+}
+
+func Test_SampledExpirer(t *testing.T) {
+	fresh := MakeTimed(nil, time.Now())
+	stale := MakeTimed(nil, time.Now().Add(-time.Hour))
+
+	for _, prob := range []float64{0, -1, math.NaN(), 0.5, 1} {
+		exp := SampledExpirer{TTL: time.Minute, EarlyProb: prob}
+		eq(t, true, exp.IsExpired(Timed{}))
+		eq(t, true, exp.IsExpired(stale))
+	}
+
+	eq(t, false, SampledExpirer{TTL: time.Minute}.IsExpired(fresh))
+	eq(t, false, SampledExpirer{TTL: time.Minute, EarlyProb: math.NaN()}.IsExpired(fresh))
+	eq(t, true, SampledExpirer{TTL: time.Minute, EarlyProb: 1}.IsExpired(fresh))
+}
+
+func Test_SampledExpirer_statistics(t *testing.T) {
+	const count = 10000
+	fresh := MakeTimed(nil, time.Now())
+
+	for _, prob := range []float64{0.01, 0.1, 0.5, 0.9} {
+		exp := SampledExpirer{
+			TTL:       time.Minute,
+			EarlyProb: prob,
+			Rand:      rand.New(rand.NewSource(1)).Float64,
+		}
+
+		var expired int
+		for range counter(count) {
+			if exp.IsExpired(fresh) {
+				expired++
+			}
+		}
+
+		ratio := float64(expired) / count
+		eq(t, true, math.Abs(ratio-prob) < 0.02)
+	}
+}
+
+func Test_SampledExpirer_Dedup(t *testing.T) {
+	const count = 10000
+	const prob = 0.5
+
+	exp := SampledExpirer{
+		TTL:       time.Minute,
+		EarlyProb: prob,
+		Rand:      rand.New(rand.NewSource(1)).Float64,
+	}
+
+	mem := NewMem(MakeTimed(nil, time.Now()))
+	for range counter(count) {
+		mem.Dedup(Either{nil}, NowTimer{}, exp)
+	}
+
+	// Both checks in `.Dedup` must report expiration.
+	ratio := float64(mem.Generation()) / count
+	eq(t, true, math.Abs(ratio-prob*prob) < 0.02)
+}
+
+func Test_ExpireNever(t *testing.T) {
+	for _, val := range testVals {
+		for _, inst := range testTimes {
+			timed := MakeTimed(val, inst)
+			eq(t, timed.IsZero(), ExpireNever{}.IsExpired(timed))
+		}
+	}
+
+	var mem Mem
+	eq(t, MakeTimed(10, testTimes[1]), mem.Dedup(Either{10}, Inst(testTimes[1]), ExpireNever{}))
+	eq(t, MakeTimed(10, testTimes[1]), mem.Dedup(failGetter(t), failTimer(t), ExpireNever{}))
+	eq(t, MakeTimed(10, testTimes[1]), mem.Dedup(failGetter(t), failTimer(t), ExpireNever{}))
+}
+
+func Test_ExpireAt(t *testing.T) {
+	past := ExpireAt(time.Now().Add(-time.Second))
+	future := ExpireAt(time.Now().Add(time.Hour))
+
+	for _, val := range testVals {
+		for _, inst := range append(testTimes, time.Now()) {
+			timed := MakeTimed(val, inst)
+			eq(t, true, past.IsExpired(timed))
+			eq(t, timed.IsZero(), future.IsExpired(timed))
+		}
+	}
+
+	var mem Mem
+	eq(t, MakeTimed(10, time.Time{}), mem.Dedup(Either{10}, Void{}, future))
+	eq(t, MakeTimed(10, time.Time{}), mem.Dedup(Either{20}, Void{}, future))
+	eq(t, MakeTimed(20, time.Time{}), mem.Dedup(Either{20}, Void{}, past))
+}
+
+type testVersioned struct {
+	Version string
+	Body    string
+}
+
+func Test_VersionExpirer(t *testing.T) {
+	want := `v1`
+	exp := VersionExpirer{
+		Want:    func() interface{} { return want },
+		Version: func(val interface{}) interface{} { return val.(testVersioned).Version },
+		Inner:   ExpireMinute{},
+	}
+	now := time.Now()
+	old := now.Add(-time.Hour)
+
+	eq(t, true, exp.IsExpired(Timed{}))
+	eq(t, false, exp.IsExpired(MakeTimed(testVersioned{`v1`, `body`}, now)))
+	eq(t, true, exp.IsExpired(MakeTimed(testVersioned{`v0`, `body`}, now)))
+	eq(t, true, exp.IsExpired(MakeTimed(testVersioned{`v1`, `body`}, old)))
+	eq(t, true, exp.IsExpired(MakeTimed(testVersioned{`v0`, `body`}, old)))
+
+	want = `v2`
+	eq(t, true, exp.IsExpired(MakeTimed(testVersioned{`v1`, `body`}, now)))
+	eq(t, false, exp.IsExpired(MakeTimed(testVersioned{`v2`, `body`}, now)))
+
+	exp.Inner = nil
+	eq(t, false, exp.IsExpired(MakeTimed(testVersioned{`v2`, `body`}, old)))
+	eq(t, true, exp.IsExpired(MakeTimed(testVersioned{`v1`, `body`}, old)))
+
+	exp.Version = nil
+	eq(t, false, exp.IsExpired(MakeTimed(`v2`, old)))
+	eq(t, true, exp.IsExpired(MakeTimed(`v1`, old)))
+
+	exp.Want = nil
+	eq(t, false, exp.IsExpired(MakeTimed(`v1`, old)))
+	eq(t, true, exp.IsExpired(Timed{}))
+}
+
+func Test_ExpirerFunc(t *testing.T) {
+	for _, val := range testVals {
+		for _, inst := range testTimes {
+			timed := MakeTimed(val, inst)
+			eq(t, true, ExpirerFunc(nil).IsExpired(timed))
+			eq(t, true, IsExpired(ExpirerFunc(nil), timed))
+			eq(t, false, ExpirerFunc(func(Timed) bool { return false }).IsExpired(timed))
+			eq(t, true, ExpirerFunc(func(Timed) bool { return true }).IsExpired(timed))
+			eq(t, timed.IsZero(), ExpirerFunc(Timed.IsZero).IsExpired(timed))
+		}
+	}
+
+	var mem Mem
+	exp := ExpirerFunc(Timed.IsZero)
+	eq(t, MakeTimed(10, time.Time{}), mem.Dedup(Either{10}, Void{}, exp))
+	eq(t, MakeTimed(10, time.Time{}), mem.Dedup(failGetter(t), failTimer(t), exp))
+}
+
+type testExpiring struct {
+	Name    string
+	Expires time.Time
+}
+
+func Test_ValueExpirer(t *testing.T) {
+	eq(t, true, ValueExpirer(nil).IsExpired(Timed{}))
+
+	exp := ValueExpirer(func(timed Timed) bool {
+		val, err := timed.Unwrap()
+		if err != nil {
+			return true
+		}
+		inner, ok := val.(testExpiring)
+		return !ok || time.Now().After(inner.Expires)
+	})
+
+	fresh := testExpiring{`fresh`, time.Now().Add(time.Hour)}
+	stale := testExpiring{`stale`, time.Now().Add(-time.Hour)}
+
+	eq(t, true, exp.IsExpired(Timed{}))
+	eq(t, true, exp.IsExpired(MakeTimed(testErr(), time.Now())))
+	eq(t, false, exp.IsExpired(MakeTimed(fresh, time.Time{})))
+	eq(t, true, exp.IsExpired(MakeTimed(stale, time.Now())))
+
+	var mem Mem
+	eq(t, MakeTimed(fresh, time.Time{}), mem.Dedup(Either{fresh}, Void{}, exp))
+	eq(t, MakeTimed(fresh, time.Time{}), mem.Dedup(Either{stale}, Void{}, exp))
+}
+
+func Test_DeadlineTimer(t *testing.T) {
+	before := time.Now()
+	inst := DeadlineTimer{time.Hour}.Time()
+	after := time.Now()
+
+	eq(t, false, inst.Before(before.Add(time.Hour)))
+	eq(t, false, inst.After(after.Add(time.Hour)))
+
+	var mem Mem
+	timed := mem.Dedup(Either{10}, DeadlineTimer{time.Hour}, NowExpirer{})
+	eq(t, timed, mem.Dedup(Either{20}, DeadlineTimer{time.Hour}, NowExpirer{}))
+
+	timed = mem.Dedup(Either{30}, DeadlineTimer{-time.Hour}, Void{})
+	eq(t, true, NowExpirer{}.IsExpired(timed))
+}
+
+func Test_WithExpirer(t *testing.T) {
+	eq(t, Timed{}, WithExpirer(nil, Void{}))
+
+	var calls int
+	getter := func() interface{} {
+		calls++
+		return calls
+	}
+
+	// Forced refresh.
+	val := &testOmni{get: getter}
+	eq(t, MakeTimed(1, time.Time{}), Dedup(val))
+	eq(t, MakeTimed(1, time.Time{}), Dedup(val))
+	eq(t, MakeTimed(2, time.Time{}), WithExpirer(val, Void{}))
+	eq(t, MakeTimed(3, time.Time{}), WithExpirer(val, nil))
+	eq(t, MakeTimed(3, time.Time{}), Dedup(val))
+
+	// Forced reuse of a value that the embedded expirer considers expired.
+	omni := NewOmni(getter, BoolExpirer(true))
+	eq(t, 4, Dedup(omni).Get())
+	eq(t, 4, WithExpirer(omni, Duration(time.Hour)).Get())
+	eq(t, 4, WithExpirer(omni, ExpireNever{}).Get())
+	eq(t, 5, Dedup(omni).Get())
+}
+
+func Test_OffsetTimer(t *testing.T) {
+	test := func(offset time.Duration) {
+		t.Helper()
+		before := time.Now()
+		inst := OffsetTimer{offset}.Time()
+		after := time.Now()
+
+		eq(t, false, inst.Before(before.Add(offset)))
+		eq(t, false, inst.After(after.Add(offset)))
+	}
+
+	test(0)
+	test(time.Hour)
+	test(-time.Hour)
+
+	// Values stamped in the past expire sooner.
+	var mem Mem
+	timed := mem.Dedup(Either{10}, OffsetTimer{-time.Hour * 2}, nil)
+	eq(t, true, Duration(time.Hour).IsExpired(timed))
+
+	// Values stamped in the future remain fresh longer.
+	timed = mem.Dedup(Either{20}, OffsetTimer{time.Hour}, nil)
+	eq(t, false, Duration(time.Minute).IsExpired(timed))
+	eq(t, MakeTimed(20, timed.Time), mem.Dedup(failGetter(t), failTimer(t), Duration(time.Minute)))
+}
+
+func Test_DedupWithDefault(t *testing.T) {
+	defer func(prev Expirer) { DefaultExpirer = prev }(DefaultExpirer)
+
+	eq(t, ExpireMinute{}, DefaultExpirer)
+	eq(t, Timed{}, DedupWithDefault(nil, failGetter(t), failTimer(t)))
+
+	var mem Mem
+	now := time.Now()
+	eq(t, MakeTimed(10, now), DedupWithDefault(&mem, Either{10}, Inst(now)))
+	eq(t, MakeTimed(10, now), DedupWithDefault(&mem, failGetter(t), failTimer(t)))
+
+	DefaultExpirer = BoolExpirer(true)
+	eq(t, MakeTimed(20, now), DedupWithDefault(&mem, Either{20}, Inst(now)))
+
+	DefaultExpirer = BoolExpirer(false)
+	eq(t, MakeTimed(20, now), DedupWithDefault(&mem, failGetter(t), failTimer(t)))
+
+	DefaultExpirer = nil
+	eq(t, MakeTimed(30, now), DedupWithDefault(&mem, Either{30}, Inst(now)))
+}
+
+func Test_DedupAll(t *testing.T) {
+	eq(t, []Timed(nil), DedupAll())
+
+	one := &testOmni{get: func() interface{} { return 10 }}
+	two := &testOmni{get: func() interface{} { return 20 }}
+
+	eq(
+		t,
+		[]Timed{MakeTimed(10, time.Time{}), {}, MakeTimed(20, time.Time{})},
+		DedupAll(one, nil, two),
+	)
+
+	eq(t, MakeTimed(10, time.Time{}), one.GetTimed())
+	eq(t, MakeTimed(20, time.Time{}), two.GetTimed())
+}
+
+func Test_DedupAll_concurrent(t *testing.T) {
+	const count = 4
+	var barrier sync.WaitGroup
+	barrier.Add(count)
+
+	// Each getter waits for all others to start, which is possible only when
+	// they run concurrently.
+	getter := func(val int) GetterFunc {
+		return func() interface{} {
+			barrier.Done()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				barrier.Wait()
+			}()
+
+			select {
+			case <-done:
+				return val
+			case <-time.After(time.Second):
+				return testErr()
+			}
+		}
+	}
+
+	var vals []Omni
+	var exp []Timed
+	for i := range counter(count) {
+		vals = append(vals, &testOmni{get: getter(i)})
+		exp = append(exp, MakeTimed(i, time.Time{}))
+	}
+
+	eq(t, exp, DedupAll(vals...))
+}
+
+func Test_NewOmni(t *testing.T) {
+	var calls int64
+	tar := NewOmni(func() interface{} { return atomic.AddInt64(&calls, 1) }, ExpireMinute{})
+
+	first := Dedup(tar)
+	eq(t, int64(1), first.Get())
+	eq(t, false, first.Time.IsZero())
+	eq(t, first, Dedup(tar))
+	eq(t, int64(1), calls)
+
+	var wg sync.WaitGroup
+	for range counter(8) {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			eq(t, first, Dedup(tar))
+		}()
+	}
+	wg.Wait()
+	eq(t, int64(1), calls)
+
+	eq(t, int64(2), Dedup(NewOmni(tar.Get, nil)).Get())
+	eq(t, nil, Dedup(NewOmni(nil, nil)).Get())
+}
+
+func Test_Get(t *testing.T) {
+	eq(t, nil, Get(nil))
+	eq(t, 10, Get(Either{10}))
+	eq(t, 10, Get(MakeTimed(10, testTimes[1])))
+	eq(t, 10, Get(GetterFunc(func() interface{} { return 10 })))
+
+	err := testErr()
+	panics(t, err, func() { Get(Either{err}) })
+}
+
+func Test_Time(t *testing.T) {
+	eq(t, time.Time{}, Time(nil))
+	eq(t, testTimes[1], Time(Inst(testTimes[1])))
+}
+
+func Test_GetErr(t *testing.T) {
+	test := func(src Getter, expVal interface{}, expErr error) {
+		t.Helper()
+		val, err := GetErr(src)
+		eq(t, expVal, val)
+		eq(t, expErr, err)
+	}
+
+	err := testErr()
+
+	test(nil, nil, nil)
+
+	test(Either{10}, 10, nil)
+	test(Either{err}, nil, err)
+	test(MakeTimed(10, testTimes[1]), 10, nil)
+	test(MakeTimed(err, testTimes[1]), nil, err)
+
+	test(GetterFunc(func() interface{} { return 10 }), 10, nil)
+	test(GetterFunc(func() interface{} { return err }), nil, err)
+	test(GetterFunc(func() interface{} { panic(err) }), nil, err)
+
+	val, outErr := GetErr(GetterFunc(func() interface{} { panic(`some string`) }))
+	eq(t, nil, val)
+	eqPanicErr(t, `some string`, outErr)
+
+	test(NewMem(MakeTimed(10, testTimes[1])), 10, nil)
+	test(NewMem(MakeTimed(err, testTimes[1])), nil, err)
+}
+
+func Test_ExpireAfter(t *testing.T) {
+	eq(t, Duration(time.Minute), ExpireAfter(time.Minute))
+
+	now := time.Now()
+	for _, inst := range append(testTimes, now, now.Add(-time.Hour), now.Add(time.Hour)) {
+		val := MakeTimed(nil, inst)
+		eq(t, Duration(time.Minute).IsExpired(val), ExpireAfter(time.Minute).IsExpired(val))
+	}
+
+	if strconv.IntSize == 64 {
+		eq(t, float64(0), testing.AllocsPerRun(100, benchExpireAfter))
+	}
+}
+
+//go:noinline
+func benchExpireAfter() { ExpireAfter(time.Minute).IsExpired(Timed{}) }
+
+func Test_Duration_text(t *testing.T) {
+	test := func(src Duration, text string) {
+		t.Helper()
+
+		out, err := src.MarshalText()
+		eq(t, nil, err)
+		eq(t, text, string(out))
+
+		var tar Duration = 123
+		eq(t, nil, tar.UnmarshalText(out))
+		eq(t, src, tar)
+	}
+
+	test(0, `0s`)
+	test(Duration(90*time.Second), `1m30s`)
+	test(Duration(-time.Millisecond), `-1ms`)
+
+	var tar Duration = 123
+	eq(t, nil, tar.UnmarshalText(nil))
+	eq(t, Duration(0), tar)
+	eq(t, true, tar.UnmarshalText([]byte(`wrong`)) != nil)
+}
+
+func Test_Inst_Add_Sub(t *testing.T) {
+	base := Inst(testTimes[1])
+
+	eq(t, Inst(testTimes[1].Add(time.Hour)), base.Add(time.Hour))
+	eq(t, Inst(testTimes[1].Add(-time.Hour)), base.Add(-time.Hour))
+	eq(t, base, base.Add(0))
+
+	eq(t, time.Hour, base.Add(time.Hour).Sub(base))
+	eq(t, -time.Hour, base.Sub(base.Add(time.Hour)))
+	eq(t, time.Duration(0), base.Sub(base))
+
+	// The zero value is not special.
+	eq(t, Inst(time.Time{}.Add(time.Hour)), Inst{}.Add(time.Hour))
+	eq(t, time.Duration(0), Inst{}.Sub(Inst{}))
+	eq(t, time.Hour, Inst{}.Add(time.Hour).Sub(Inst{}))
+	eq(t, testTimes[1].Sub(time.Time{}), base.Sub(Inst{}))
+
+	// Saturates like `time.Time.Sub`.
+	modern := Inst(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	eq(t, time.Duration(math.MaxInt64), modern.Sub(Inst{}))
+	eq(t, time.Duration(math.MinInt64), Inst{}.Sub(modern))
+
+	// Composes with expiration.
+	exp := base.Add(time.Hour)
+	eq(t, false, exp.IsExpired(MakeTimed(nil, testTimes[1])))
+	eq(t, true, exp.IsExpired(MakeTimed(nil, testTimes[1].Add(time.Hour*2))))
+}
+
+func Test_Inst_text(t *testing.T) {
+	test := func(src Inst, text string) {
+		t.Helper()
+
+		out, err := src.MarshalText()
+		eq(t, nil, err)
+		eq(t, text, string(out))
+
+		tar := Inst(time.Now())
+		eq(t, nil, tar.UnmarshalText(out))
+		eq(t, true, src.Time().Equal(tar.Time()))
+	}
+
+	test(Inst{}, ``)
+	test(Inst(testTimes[1]), `0001-02-03T04:05:06.000000007Z`)
+	test(Inst(time.Date(2021, 10, 18, 12, 30, 0, 0, time.UTC)), `2021-10-18T12:30:00Z`)
+	test(Inst(time.Date(2021, 10, 18, 12, 30, 0, 0, time.FixedZone(``, 3600))), `2021-10-18T12:30:00+01:00`)
+
+	var tar Inst
+	eq(t, true, tar.UnmarshalText([]byte(`wrong`)) != nil)
+}
+
+func Test_fixed_duration_expirers(t *testing.T) {
+	test := func(exp Expirer, dur time.Duration) {
+		t.Helper()
+		now := time.Now()
+
+		eq(t, true, exp.IsExpired(Timed{}))
+		eq(t, false, exp.IsExpired(MakeTimed(nil, now)))
+		eq(t, false, exp.IsExpired(MakeTimed(nil, now.Add(-dur+time.Millisecond*100))))
+		eq(t, true, exp.IsExpired(MakeTimed(nil, now.Add(-dur-time.Millisecond))))
+	}
+
+	test(ExpireSecond{}, time.Second)
+	test(ExpireMinute{}, time.Minute)
+	test(ExpireHour{}, time.Hour)
+	test(ExpireDay{}, time.Hour*24)
+	test(ExpireWeek{}, time.Hour*24*7)
+	test(ExpireMonth{}, time.Hour*24*30)
+}
+
+func Benchmark_Mem_refresh(b *testing.B) {
+	mem := new(Mem)
+	b.ResetTimer()
+	for range counter(b.N) {
+		benchMemRefresh(mem)
+	}
+}
+
+// Same as `Benchmark_Mem_refresh`, but the getter allocates, like real getters
+// usually do. The benchmark should show the getter's allocations: the slice and
+// its conversion to `interface{}`, plus the one `Timed` published by each
+// regeneration, which reusing or pooling couldn't avoid, because readers may
+// still hold the previous one.
+func Benchmark_Mem_refresh_allocating_getter(b *testing.B) {
+	mem := new(Mem)
+	getter := GetterFunc(allocatingGetter)
+	b.ResetTimer()
+	for range counter(b.N) {
+		mem.Dedup(getter, Void{}, BoolExpirer(true))
+	}
+}
+
+//go:noinline
+func allocatingGetter() interface{} { return make([]byte, 64) }
+
+//go:noinline
+func benchMemRefresh(mem *Mem) {
+	// Should regenerate the value every time, using a write lock.
+	// All these interface conversions should be zero-alloc.
+	// The benchmark should show one alloc: the published `Timed`.
+	mem.Dedup(GetterFunc(staticGetter), Void{}, BoolExpirer(true))
+}
+
+func Benchmark_Mem_DedupArg_hit(b *testing.B) {
+	mem := NewMem(MakeTimed(10, time.Time{}))
+	arg := new(int)
+	b.ResetTimer()
+	for range counter(b.N) {
+		mem.DedupArg(arg, argIdentity, Void{}, BoolExpirer(false))
+	}
+}
+
+func Benchmark_Mem_DedupArg_refresh(b *testing.B) {
+	mem := new(Mem)
+	arg := new(int)
+	b.ResetTimer()
+	for range counter(b.N) {
+		mem.DedupArg(arg, argIdentity, Void{}, BoolExpirer(true))
+	}
+}
+
+func argIdentity(val interface{}) interface{} { return val }
@@ -58,6 +58,18 @@ func funcName(val interface{}) string {
 
 func testErr() error { return fmt.Errorf(`some error`) }
 
+// Asserts that the value is a `*PanicError` with the given panic value and a
+// non-empty stack trace.
+func eqPanicErr(t testing.TB, exp interface{}, act interface{}) {
+	t.Helper()
+	err, _ := act.(*PanicError)
+	if err == nil {
+		t.Fatalf(`expected *PanicError, found %#v`, act)
+	}
+	eq(t, exp, err.Value)
+	eq(t, true, len(err.Stack) > 0)
+}
+
 func testGet(t testing.TB, val interface{}, src Getter) {
 	err, _ := val.(error)
 	if err != nil {
@@ -135,23 +147,41 @@ func failTimer(t testing.TB) Timer {
 	return TimerFunc(func() time.Time { t.Fail(); return time.Time{} })
 }
 
+func failExpiringGetter(t testing.TB) ExpiringGetter {
+	return ExpiringGetterFunc(func() (interface{}, time.Time) { t.Fail(); return nil, time.Time{} })
+}
+
+func failMapper(t testing.TB) func(interface{}) interface{} {
+	return func(interface{}) interface{} { t.Fail(); return nil }
+}
+
 func newSlowGetter(val interface{}) *slowGetter {
 	var out slowGetter
 	out.Add(1)
 	out.Store(val)
+	out.entered = make(chan struct{})
 	return &out
 }
 
 type slowGetter struct {
 	sync.WaitGroup
 	atomic.Value
+	once    sync.Once
+	entered chan struct{}
 }
 
 func (self *slowGetter) Get() interface{} {
+	self.once.Do(func() { close(self.entered) })
 	self.Wait()
 	return Either{self.Load()}.Get()
 }
 
+/*
+Closed when `.Get` is first called. Used by tests to wait until a writer is
+inside the getter, and therefore holds the write lock.
+*/
+func (self *slowGetter) Entered() <-chan struct{} { return self.entered }
+
 func isDone(val <-chan struct{}) bool {
 	select {
 	case <-val:
@@ -163,3 +193,37 @@ func isDone(val <-chan struct{}) bool {
 
 // In Go 1.17, constant-to-interface doesn't alloc.
 func staticGetter() interface{} { return `some val` }
+
+// Fake clock for deterministic expiration tests.
+type testClock struct {
+	sync.Mutex
+	inst time.Time
+}
+
+func (self *testClock) Now() time.Time {
+	self.Lock()
+	defer self.Unlock()
+	return self.inst
+}
+
+func (self *testClock) Add(dur time.Duration) {
+	self.Lock()
+	defer self.Unlock()
+	self.inst = self.inst.Add(dur)
+}
+
+// Expires only the zero value, which allows exactly one regeneration.
+type IsZeroExpirer struct{}
+
+func (IsZeroExpirer) IsExpired(val Timed) bool { return val.IsZero() }
+
+// Minimal `Omni` whose getter is provided as a func, and which expires only
+// the zero value.
+type testOmni struct {
+	Mem
+	get GetterFunc
+}
+
+func (self *testOmni) Get() interface{}    { return self.get.Get() }
+func (*testOmni) Time() time.Time          { return time.Time{} }
+func (*testOmni) IsExpired(val Timed) bool { return val.IsZero() }
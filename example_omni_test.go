@@ -0,0 +1,22 @@
+package ded_test
+
+import (
+	"fmt"
+
+	"github.com/mitranim/ded"
+)
+
+func ExampleNewOmni() {
+	worker := ded.NewOmni(func() interface{} { return `some value` }, ded.ExpireMinute{})
+	first := ded.Dedup(worker)
+	second := ded.Dedup(worker)
+
+	// The value is reused without calling the getter again, keeping the old
+	// timestamp, because it's not expired yet (a minute hasn't passed).
+	fmt.Println(first == second)
+	fmt.Println(first.Get())
+
+	// Output:
+	// true
+	// some value
+}